@@ -60,3 +60,19 @@ Create the name of the service account to use
 {{- default "default" .Values.serviceAccount.name }}
 {{- end }}
 {{- end }}
+
+{{/*
+With self-managed TLS the webhook injects its CA bundle at runtime. Keep the
+injected bundle on upgrades so the API server can keep calling the webhook.
+*/}}
+{{- define "ecr-pull-through.existingCABundle" -}}
+{{- $root := index . 0 -}}
+{{- if eq $root.Values.tls.mode "self-managed" -}}
+{{- $existing := lookup "admissionregistration.k8s.io/v1" (index . 1) "" (include "ecr-pull-through.fullname" $root) -}}
+{{- if $existing -}}
+{{- with (first $existing.webhooks) -}}
+{{- .clientConfig.caBundle | default "" -}}
+{{- end -}}
+{{- end -}}
+{{- end -}}
+{{- end }}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// defaultRegistryAliases are the registryAliases applied unless the config
+// maps the same alias: Docker Hub's API hostnames, and the frozen k8s.gcr.io
+// that redirects to registry.k8s.io.
+var defaultRegistryAliases = map[string]string{
+	"index.docker.io":      "docker.io",
+	"registry-1.docker.io": "docker.io",
+	"k8s.gcr.io":           "registry.k8s.io",
+}
+
+// registryAliases returns the alias table of the config: the defaults
+// overlaid with registryAliases, where an empty canonical hostname removes
+// the alias:
+//
+//	registryAliases:             # alias -> canonical registry
+//	  mirror.gcr.io: docker.io
+//	  k8s.gcr.io: ""             # keep k8s.gcr.io images as they are
+func (c *config) registryAliases() map[string]string {
+	aliases := maps.Clone(defaultRegistryAliases)
+	for alias, canonical := range c.RegistryAliases {
+		if canonical == "" {
+			delete(aliases, alias)
+			continue
+		}
+		aliases[alias] = canonical
+	}
+	return aliases
+}
+
+// validateRegistryAliases reports invalid hostnames, chained aliases and
+// configured registries that are aliases, prefixed with their key.
+func (c *config) validateRegistryAliases() error {
+	var errs []error
+	for _, alias := range slices.Sorted(maps.Keys(c.RegistryAliases)) {
+		canonical := c.RegistryAliases[alias]
+		key := fmt.Sprintf("registryAliases[%s]", alias)
+		switch {
+		case !hostnamePattern.MatchString(alias):
+			errs = append(errs, fmt.Errorf("registryAliases: %q is not a valid registry hostname", alias))
+		case canonical != "" && !hostnamePattern.MatchString(canonical):
+			errs = append(errs, fmt.Errorf("%s: %q is not a valid registry hostname", key, canonical))
+		case canonical == alias:
+			errs = append(errs, fmt.Errorf("%s: an alias cannot name itself, map it to \"\" to remove it", key))
+		}
+	}
+	aliases := c.registryAliases()
+	for _, alias := range slices.Sorted(maps.Keys(aliases)) {
+		if next, ok := aliases[aliases[alias]]; ok {
+			errs = append(errs, fmt.Errorf("registryAliases[%s]: %q is itself an alias of %q, map it to %q directly", alias, aliases[alias], next, next))
+		}
+	}
+	for i, r := range c.Registries {
+		if canonical, ok := aliases[r.Host]; ok {
+			errs = append(errs, fmt.Errorf("registries[%d]: %q is an alias of %q and never matches, configure %q or map the alias to \"\" in registryAliases", i, r.Host, canonical, canonical))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parseImage parses image like parseReference, then replaces an aliased
+// registry with its canonical hostname. Rules, registries and the rewritten
+// image all see the canonical reference.
+func (s *server) parseImage(image string) (reference, error) {
+	ref, err := parseReference(image)
+	if err != nil {
+		return ref, err
+	}
+	if canonical, ok := s.aliases[ref.Domain]; ok {
+		ref.Domain = canonical
+		if ref.Domain+"/" == dockerHubRegistry && !strings.ContainsRune(ref.Path, '/') {
+			ref.Path = "library/" + ref.Path
+		}
+	}
+	return ref, nil
+}
+
+// aliasReplacements returns, ordered by alias, the replacements generated
+// policies apply to normalized references to canonicalize their registry.
+func (s *server) aliasReplacements() []regexReplacement {
+	var replacements []regexReplacement
+	for _, alias := range slices.Sorted(maps.Keys(s.aliases)) {
+		replacements = append(replacements, regexReplacement{regexp.MustCompile(`^` + regexp.QuoteMeta(alias) + `/`), s.aliases[alias] + "/"})
+	}
+	return replacements
+}
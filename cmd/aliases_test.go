@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRewriteImage_Aliases(t *testing.T) {
+	srv := setupServer(t, "123456789012", "us-west-2", "docker.io=dockerhub,registry.k8s.io")
+
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"index.docker.io/nginx:1.27", "123456789012.dkr.ecr.us-west-2.amazonaws.com/dockerhub/library/nginx:1.27"},
+		{"index.docker.io/library/nginx", "123456789012.dkr.ecr.us-west-2.amazonaws.com/dockerhub/library/nginx"},
+		{"registry-1.docker.io/owner/app@" + testDigest, "123456789012.dkr.ecr.us-west-2.amazonaws.com/dockerhub/owner/app@" + testDigest},
+		{"k8s.gcr.io/pause:3.9", "123456789012.dkr.ecr.us-west-2.amazonaws.com/registry.k8s.io/pause:3.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			got, ok, err := srv.rewriteImage(tt.image)
+			if err != nil || !ok {
+				t.Fatalf("rewriteImage(%q) = %q, %v, %v", tt.image, got, ok, err)
+			}
+			if got != tt.want {
+				t.Errorf("rewriteImage(%q) = %q, want %q", tt.image, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryAliases_Config(t *testing.T) {
+	clearConfigEnv(t)
+	cfg, err := loadConfig(writeConfig(t, `awsAccountId: "123456789012"
+awsRegion: us-west-2
+registries: [docker.io, k8s.gcr.io]
+registryAliases:
+  mirror.gcr.io: docker.io
+  k8s.gcr.io: ""
+rules:
+  - match: docker.io/bitnami/**
+    action: skip
+`), true)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	srv, err := newServerFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("newServerFromConfig: %v", err)
+	}
+
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"mirror.gcr.io/library/busybox", "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/busybox"},
+		{"index.docker.io/busybox", "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/busybox"},
+		// A removed alias keeps its own registry.
+		{"k8s.gcr.io/pause:3.9", "123456789012.dkr.ecr.us-west-2.amazonaws.com/k8s.gcr.io/pause:3.9"},
+		// Rules match the canonical name.
+		{"mirror.gcr.io/bitnami/redis", ""},
+	}
+	for _, tt := range tests {
+		got, _, err := srv.rewriteImage(tt.image)
+		if err != nil {
+			t.Fatalf("rewriteImage(%q): %v", tt.image, err)
+		}
+		if got != tt.want {
+			t.Errorf("rewriteImage(%q) = %q, want %q", tt.image, got, tt.want)
+		}
+	}
+
+	if reason, err := srv.checkImage("index.docker.io/nginx", srv.targets[defaultTarget]); err != nil || !strings.Contains(reason, "upstream registry docker.io") {
+		t.Errorf("checkImage(index.docker.io/nginx) = %q, %v, want it pulled from docker.io", reason, err)
+	}
+}
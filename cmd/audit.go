@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+)
+
+// imageRewrite records an image field the webhook rewrote, or would rewrite
+// in dry-run mode.
+type imageRewrite struct {
+	Path      string `json:"path"`
+	Container string `json:"container,omitempty"`
+	Original  string `json:"original"`
+	Rewritten string `json:"rewritten"`
+}
+
+func (rw imageRewrite) label() string {
+	return imageField{path: rw.Path, container: rw.Container}.label()
+}
+
+// isDryRun reports whether requests in namespace are only audited, either
+// because dry run is enabled globally or the namespace matches one of the
+// dryRunNamespaces patterns.
+func (s *server) isDryRun(namespace string) bool {
+	if s.dryRun {
+		return true
+	}
+	return slices.ContainsFunc(s.dryRunNamespaces, func(pattern string) bool {
+		ok, _ := path.Match(pattern, namespace)
+		return ok
+	})
+}
+
+// auditAnnotations records the applied rewrites in the API server audit
+// log. The API server prefixes the key with the webhook name.
+func auditAnnotations(rewrites []imageRewrite) (map[string]string, error) {
+	if len(rewrites) == 0 {
+		return nil, nil
+	}
+	v, err := json.Marshal(rewrites)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal audit annotation: %w", err)
+	}
+	return map[string]string{"rewrites": string(v)}, nil
+}
+
+// dryRunReport describes what the webhook would have done as admission
+// warnings, shown by kubectl, and audit annotations, recorded in the API
+// server audit log.
+func dryRunReport(rewrites []imageRewrite, rejections []string) ([]string, map[string]string, error) {
+	var warnings []string
+	annotations := map[string]string{}
+	for _, rw := range rewrites {
+		warnings = append(warnings, fmt.Sprintf("dry run: %s image %q would be rewritten to %q", rw.label(), rw.Original, rw.Rewritten))
+	}
+	for _, r := range rejections {
+		warnings = append(warnings, fmt.Sprintf("dry run: would be rejected: %s", r))
+	}
+	if len(rewrites) > 0 {
+		v, err := json.Marshal(rewrites)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to marshal audit annotation: %w", err)
+		}
+		annotations["dry-run-rewrites"] = string(v)
+	}
+	if len(rejections) > 0 {
+		v, err := json.Marshal(rejections)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to marshal audit annotation: %w", err)
+		}
+		annotations["dry-run-rejections"] = string(v)
+	}
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	return warnings, annotations, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMutate_AuditAnnotationsAndWarnings(t *testing.T) {
+	srv := setupServerWithRules(t,
+		[]registryConfig{{Host: "docker.io"}},
+		[]ruleConfig{{Match: "ghcr.io/exempt/**", Action: actionSkip}})
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Image: "busybox"}},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "nginx:1.27"},
+				{Name: "proxy", Image: "quay.io/org/proxy:1"},
+				{Name: "exempt", Image: "ghcr.io/exempt/tool:1"},
+				{Name: "private", Image: "111111111111.dkr.ecr.eu-west-1.amazonaws.com/team/app:1"},
+				{Name: "cached", Image: srv.ecrRegistryHostname + "docker.io/library/redis:7"},
+			},
+		},
+	}
+	out := reviewPod(t, srv, pod)
+	if !out.Response.Allowed {
+		t.Fatalf("expected pod to be allowed, got %v", out.Response.Result)
+	}
+
+	var rewrites []imageRewrite
+	if err := json.Unmarshal([]byte(out.Response.AuditAnnotations["rewrites"]), &rewrites); err != nil {
+		t.Fatalf("unmarshal rewrites annotation: %v", err)
+	}
+	wantRewrites := []imageRewrite{
+		{Path: "/spec/containers/0/image", Container: "app", Original: "nginx:1.27", Rewritten: srv.ecrRegistryHostname + "docker.io/library/nginx:1.27"},
+		{Path: "/spec/initContainers/0/image", Container: "init", Original: "busybox", Rewritten: srv.ecrRegistryHostname + "docker.io/library/busybox"},
+	}
+	if !slices.Equal(rewrites, wantRewrites) {
+		t.Fatalf("rewrites = %+v, want %+v", rewrites, wantRewrites)
+	}
+
+	// Skip rules, ECR registries and cached images are deliberate and not
+	// warned about.
+	wantWarnings := []string{`container "proxy": image "quay.io/org/proxy:1" was not rewritten, registry quay.io is not configured`}
+	if !slices.Equal(out.Response.Warnings, wantWarnings) {
+		t.Fatalf("warnings = %q, want %q", out.Response.Warnings, wantWarnings)
+	}
+}
+
+func TestMutate_NoRewritesNoAnnotations(t *testing.T) {
+	srv := setupServer(t, "123456789012", "us-west-2", "docker.io")
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: srv.ecrRegistryHostname + "docker.io/library/nginx"}},
+		},
+	}
+	out := reviewPod(t, srv, pod)
+	if out.Response.AuditAnnotations != nil || out.Response.Warnings != nil {
+		t.Fatalf("unexpected annotations %v or warnings %q", out.Response.AuditAnnotations, out.Response.Warnings)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// command is a CLI subcommand. run returns the process exit code.
+type command struct {
+	summary string
+	run     func(args []string, stdin io.Reader, stdout, stderr io.Writer) int
+}
+
+// commands are the subcommands of the binary. Without one it runs the
+// webhook server.
+var commands = map[string]command{
+	"admission-policy": {summary: "print a MutatingAdmissionPolicy equivalent to the webhook configuration", run: runAdmissionPolicy},
+	"coverage":         {summary: "report how many images of a pod snapshot use the pull-through cache", run: runCoverage},
+	"kyverno":          {summary: "print a Kyverno ClusterPolicy equivalent to the webhook configuration", run: runKyverno},
+	"render":           {summary: "rewrite the images of Kubernetes manifests read from stdin", run: runRender},
+	"rewrite":          {summary: "show what the webhook does with image references", run: runRewrite},
+}
+
+// runCommand runs the subcommand named by args[0].
+func runCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			printCommands(stdout)
+			return 0
+		}
+		fmt.Fprintf(stderr, "unknown command %q\n\n", args[0])
+		printCommands(stderr)
+		return 2
+	}
+	return cmd.run(args[1:], stdin, stdout, stderr)
+}
+
+func printCommands(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	fmt.Fprintln(w, "Usage: mutation-webhook [command] [flags]")
+	fmt.Fprintln(w, "\nWithout a command, the webhook server is started. Commands:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-18s %s\n", name, commands[name].summary)
+	}
+}
+
+// newFlagSet returns a flag set for a subcommand with the -config flag the
+// commands share. usage is the argument synopsis shown after the flags.
+func newFlagSet(name, usage string, stderr io.Writer) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configFile := fs.String("config", "", "config file (default $ECR_CONFIG_FILE or "+defaultConfigPath+")")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: mutation-webhook %s [flags] %s\n\nFlags:\n", name, usage)
+		fs.PrintDefaults()
+	}
+	return fs, configFile
+}
+
+// parseFlags parses args, returning the exit code to use when parsing stops
+// the command.
+func parseFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0, false
+		}
+		return 2, false
+	}
+	return 0, true
+}
+
+// loadServer builds a server from the config file, applying the same
+// environment overrides and validation as the webhook. An explicit path must
+// exist.
+func loadServer(path string) (*server, error) {
+	required := path != ""
+	if !required {
+		path, required = configPath()
+	}
+	cfg, err := loadConfig(path, required)
+	if err != nil {
+		return nil, err
+	}
+	return newServerFromConfig(cfg)
+}
+
+// checkOutputFormat validates the value of an -o flag.
+func checkOutputFormat(format string) error {
+	switch format {
+	case "text", "json":
+		return nil
+	}
+	return fmt.Errorf("-o: %q must be one of text or json", format)
+}
+
+// marshalYAML encodes v as YAML, keeping the field order of its JSON encoding
+// and without wrapping long strings.
+func marshalYAML(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	clearStyle(&node)
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// clearStyle drops the flow and quoting styles yaml.Unmarshal records for
+// JSON input, so the encoder picks block style and quotes only when needed.
+func clearStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, c := range node.Content {
+		clearStyle(c)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Image classes of the coverage report.
+const (
+	coverageCached       = "cached"
+	coverageRewritable   = "rewritable"
+	coverageUnconfigured = "unconfigured"
+	coverageSkipped      = "skipped"
+	coverageDenied       = "denied"
+	coverageInvalid      = "invalid"
+)
+
+// coverageCounts counts the container images of a group by class.
+type coverageCounts struct {
+	Images       int     `json:"images"`
+	Cached       int     `json:"cached"`
+	Rewritable   int     `json:"rewritable"`
+	Unconfigured int     `json:"unconfigured"`
+	Skipped      int     `json:"skipped"`
+	Denied       int     `json:"denied"`
+	Invalid      int     `json:"invalid"`
+	Coverage     float64 `json:"coverage"` // fraction of images that are cached
+}
+
+func (c *coverageCounts) add(class string) {
+	c.Images++
+	switch class {
+	case coverageCached:
+		c.Cached++
+	case coverageRewritable:
+		c.Rewritable++
+	case coverageUnconfigured:
+		c.Unconfigured++
+	case coverageSkipped:
+		c.Skipped++
+	case coverageDenied:
+		c.Denied++
+	case coverageInvalid:
+		c.Invalid++
+	}
+	c.Coverage = float64(c.Cached) / float64(c.Images)
+}
+
+// coverageReport is the output of the coverage command.
+type coverageReport struct {
+	Total      coverageCounts            `json:"total"`
+	Namespaces map[string]coverageCounts `json:"namespaces"`
+	Registries map[string]coverageCounts `json:"registries"`
+}
+
+// runCoverage implements "coverage": it classifies the container images of
+// a pod snapshot (kubectl get pods -A -o json) by whether they already go
+// through the pull-through cache.
+func runCoverage(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs, configFile := newFlagSet("coverage", "", stderr)
+	file := fs.String("f", "-", "output of kubectl get pods -A -o json, - for stdin")
+	output := fs.String("o", "text", "output format: text or json")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if err := checkOutputFormat(*output); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	srv, err := loadServer(*configFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	in := stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	var pods corev1.PodList
+	if err := json.NewDecoder(in).Decode(&pods); err != nil {
+		fmt.Fprintf(stderr, "parsing pod list: %v\n", err)
+		return 1
+	}
+
+	report := srv.coverage(pods.Items)
+	if *output == "json" {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = writeCoverageTables(stdout, report)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// coverage classifies every container image of pods.
+func (s *server) coverage(pods []corev1.Pod) coverageReport {
+	report := coverageReport{Namespaces: map[string]coverageCounts{}, Registries: map[string]coverageCounts{}}
+	for _, pod := range pods {
+		forEachContainer(&pod.Spec, "/spec", func(_, image, _ string) {
+			class, registry := s.classifyImage(image, pod.Namespace)
+			report.Total.add(class)
+			ns := report.Namespaces[pod.Namespace]
+			ns.add(class)
+			report.Namespaces[pod.Namespace] = ns
+			reg := report.Registries[registry]
+			reg.add(class)
+			report.Registries[registry] = reg
+		})
+	}
+	return report
+}
+
+// classifyImage returns the coverage class of image, against the target
+// namespaceTargets maps namespace to, and its upstream registry. For cached
+// images, the upstream registry is the one whose prefix the cached
+// repository starts with. Namespace labels and annotations are not looked
+// up, the snapshot does not include them.
+func (s *server) classifyImage(image, namespace string) (class, registry string) {
+	target := s.targets[s.namespaceTarget(namespace)]
+	d, err := s.evaluateImageAt(image, target)
+	if err != nil {
+		return coverageInvalid, "invalid"
+	}
+	ref, _ := s.parseImage(image)
+	switch {
+	case d.Cached:
+		return coverageCached, s.cachedUpstream(ref.Path, target)
+	case d.Action == actionRewrite:
+		class = coverageRewritable
+	case d.Action == actionDeny:
+		class = coverageDenied
+	case d.Unconfigured:
+		class = coverageUnconfigured
+	default:
+		class = coverageSkipped
+	}
+	return class, ref.Domain
+}
+
+// cachedUpstream returns the upstream registry of a repository path in the
+// pull-through cache of target, or the ECR registry itself when no configured
+// prefix matches.
+func (s *server) cachedUpstream(path string, target ecrTarget) string {
+	upstream, longest := strings.TrimSuffix(target.hostname, "/"), 0
+	for registry, prefix := range s.prefixes {
+		if prefix != "" && len(prefix) > longest && strings.HasPrefix(path, prefix) {
+			upstream, longest = strings.TrimSuffix(registry, "/"), len(prefix)
+		}
+	}
+	return upstream
+}
+
+func writeCoverageTables(w io.Writer, report coverageReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	writeCoverageTable(tw, "NAMESPACE", report.Namespaces, report.Total)
+	fmt.Fprintln(tw)
+	writeCoverageTable(tw, "REGISTRY", report.Registries, report.Total)
+	return tw.Flush()
+}
+
+func writeCoverageTable(w io.Writer, title string, groups map[string]coverageCounts, total coverageCounts) {
+	fmt.Fprintf(w, "%s\tIMAGES\tCACHED\tREWRITABLE\tUNCONFIGURED\tSKIPPED\tDENIED\tINVALID\tCOVERAGE\n", title)
+	row := func(name string, c coverageCounts) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%.1f%%\n", name, c.Images, c.Cached, c.Rewritable, c.Unconfigured, c.Skipped, c.Denied, c.Invalid, 100*c.Coverage)
+	}
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		row(name, groups[name])
+	}
+	row("TOTAL", total)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const coverageTestPods = `{
+  "apiVersion": "v1",
+  "kind": "List",
+  "items": [
+    {
+      "metadata": {"name": "web", "namespace": "apps"},
+      "spec": {
+        "initContainers": [{"name": "init", "image": "123456789012.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/busybox"}],
+        "containers": [
+          {"name": "app", "image": "nginx:1.27"},
+          {"name": "side", "image": "ghcr.io/org/side"}
+        ]
+      }
+    },
+    {
+      "metadata": {"name": "cache", "namespace": "data"},
+      "spec": {
+        "containers": [
+          {"name": "redis", "image": "bitnami/redis"},
+          {"name": "metrics", "image": "123456789012.dkr.ecr.us-east-1.amazonaws.com/quay.io/prom/exporter"},
+          {"name": "licensed", "image": "quay.io/licensed/app"},
+          {"name": "broken", "image": "Invalid:Image"}
+        ]
+      }
+    }
+  ]
+}`
+
+func TestCoverageCommand(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfig(t, cliTestConfig)
+
+	t.Run("json", func(t *testing.T) {
+		code, stdout, stderr := runCLI(t, coverageTestPods, "coverage", "-config", path, "-o", "json")
+		if code != 0 {
+			t.Fatalf("exit code = %d, stderr = %s", code, stderr)
+		}
+		var report coverageReport
+		if err := json.Unmarshal([]byte(stdout), &report); err != nil {
+			t.Fatalf("decode output: %v\n%s", err, stdout)
+		}
+
+		want := coverageCounts{Images: 7, Cached: 2, Rewritable: 1, Unconfigured: 1, Skipped: 1, Denied: 1, Invalid: 1, Coverage: 2.0 / 7}
+		if report.Total != want {
+			t.Errorf("total = %+v, want %+v", report.Total, want)
+		}
+		namespaces := map[string]coverageCounts{
+			"apps": {Images: 3, Cached: 1, Rewritable: 1, Unconfigured: 1, Coverage: 1.0 / 3},
+			"data": {Images: 4, Cached: 1, Skipped: 1, Denied: 1, Invalid: 1, Coverage: 0.25},
+		}
+		if len(report.Namespaces) != len(namespaces) {
+			t.Errorf("namespaces = %+v", report.Namespaces)
+		}
+		for ns, want := range namespaces {
+			if got := report.Namespaces[ns]; got != want {
+				t.Errorf("namespace %s = %+v, want %+v", ns, got, want)
+			}
+		}
+		registries := map[string]coverageCounts{
+			"docker.io": {Images: 3, Cached: 1, Rewritable: 1, Skipped: 1, Coverage: 1.0 / 3},
+			"quay.io":   {Images: 2, Cached: 1, Denied: 1, Coverage: 0.5},
+			"ghcr.io":   {Images: 1, Unconfigured: 1},
+			"invalid":   {Images: 1, Invalid: 1},
+		}
+		if len(report.Registries) != len(registries) {
+			t.Errorf("registries = %+v", report.Registries)
+		}
+		for reg, want := range registries {
+			if got := report.Registries[reg]; got != want {
+				t.Errorf("registry %s = %+v, want %+v", reg, got, want)
+			}
+		}
+	})
+
+	t.Run("text", func(t *testing.T) {
+		code, stdout, stderr := runCLI(t, coverageTestPods, "coverage", "-config", path)
+		if code != 0 {
+			t.Fatalf("exit code = %d, stderr = %s", code, stderr)
+		}
+		for _, want := range []string{"NAMESPACE", "REGISTRY", "apps", "ghcr.io", "28.6%"} {
+			if !strings.Contains(stdout, want) {
+				t.Errorf("output does not contain %q:\n%s", want, stdout)
+			}
+		}
+	})
+
+	t.Run("invalid input", func(t *testing.T) {
+		code, _, stderr := runCLI(t, "not json", "coverage", "-config", path)
+		if code != 1 || !strings.Contains(stderr, "parsing pod list") {
+			t.Errorf("exit code = %d, stderr = %q", code, stderr)
+		}
+	})
+}
+
+func TestCachedUpstream(t *testing.T) {
+	clearConfigEnv(t)
+	srv, err := loadServer(writeConfig(t, `
+awsAccountId: "123456789012"
+awsRegion: us-east-1
+registries:
+  - host: docker.io
+    prefix: hub
+  - host: hub.example.com
+    prefix: hub/example
+`))
+	if err != nil {
+		t.Fatalf("loadServer: %v", err)
+	}
+	for path, want := range map[string]string{
+		"hub/library/nginx":    "docker.io",
+		"hub/example/app":      "hub.example.com",
+		"team/app":             "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+		"hubble/observability": "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+	} {
+		if got := srv.cachedUpstream(path, srv.targets[defaultTarget]); got != want {
+			t.Errorf("cachedUpstream(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestCoverage_Targets(t *testing.T) {
+	clearConfigEnv(t)
+	srv, err := loadServer(writeConfig(t, `
+awsAccountId: "123456789012"
+awsRegion: us-east-1
+registries:
+  - host: docker.io
+targets:
+  - name: team-a
+    awsAccountId: "111111111111"
+    awsRegion: eu-west-1
+namespaceTargets:
+  payments: team-a
+`))
+	if err != nil {
+		t.Fatalf("loadServer: %v", err)
+	}
+	pod := func(namespace, image string) corev1.Pod {
+		return corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: namespace},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}},
+		}
+	}
+	report := srv.coverage([]corev1.Pod{
+		pod("payments", "111111111111.dkr.ecr.eu-west-1.amazonaws.com/docker.io/library/nginx"),
+		pod("payments", "redis"),
+		pod("apps", "123456789012.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/nginx"),
+	})
+
+	namespaces := map[string]coverageCounts{
+		"payments": {Images: 2, Cached: 1, Rewritable: 1, Coverage: 0.5},
+		"apps":     {Images: 1, Cached: 1, Coverage: 1},
+	}
+	for ns, want := range namespaces {
+		if got := report.Namespaces[ns]; got != want {
+			t.Errorf("namespace %s = %+v, want %+v", ns, got, want)
+		}
+	}
+	if got, want := report.Registries["docker.io"], (coverageCounts{Images: 3, Cached: 2, Rewritable: 1, Coverage: 2.0 / 3}); got != want {
+		t.Errorf("registry docker.io = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// podContainerFields are the pod spec fields holding containers.
+var podContainerFields = []string{"containers", "initContainers", "ephemeralContainers"}
+
+// regexReplacement is a regexp replacement used by generated policies, which
+// cannot call parseReference. Keeping them as values lets tests check them
+// against parseReference.
+type regexReplacement struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+func (r regexReplacement) apply(s string) string {
+	return r.re.ReplaceAllString(s, r.repl)
+}
+
+var (
+	// addDockerHubDomain prefixes references whose first component is not a
+	// registry (see splitDomain) with docker.io. References starting with
+	// "localhost/" must be excluded beforehand.
+	addDockerHubDomain = regexReplacement{regexp.MustCompile(`^([a-z0-9_-]+/|[^/]+$)`), dockerHubRegistry + "${1}"}
+	// addDockerHubLibrary moves single-component Docker Hub paths under library/.
+	addDockerHubLibrary = regexReplacement{regexp.MustCompile(`^` + regexp.QuoteMeta(dockerHubRegistry) + `([^/]+)$`), dockerHubRegistry + "library/${1}"}
+	// trimTagAndDigest turns a normalized reference into its repository name.
+	trimTagAndDigest = regexReplacement{regexp.MustCompile(`(:[^/@]*)?(@.*)?$`), ""}
+	// trimPath turns a normalized reference into its registry.
+	trimPath = regexReplacement{regexp.MustCompile(`/.*$`), ""}
+)
+
+// normalizeWithRegexps normalizes a valid reference like parseReference, using
+// only the replacements available to generated policies.
+func normalizeWithRegexps(image string) (ref, name, domain string) {
+	ref = image
+	if !strings.HasPrefix(image, "localhost/") {
+		ref = addDockerHubDomain.apply(image)
+	}
+	ref = addDockerHubLibrary.apply(ref)
+	return ref, trimTagAndDigest.apply(ref), trimPath.apply(ref)
+}
+
+// kyvernoClusterPolicy is the subset of the Kyverno ClusterPolicy schema the
+// generator emits.
+type kyvernoClusterPolicy struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name        string            `json:"name"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		ValidationFailureAction string        `json:"validationFailureAction"`
+		Background              bool          `json:"background"`
+		Rules                   []kyvernoRule `json:"rules"`
+	} `json:"spec"`
+}
+
+type kyvernoRule struct {
+	Name          string             `json:"name"`
+	Match         map[string]any     `json:"match"`
+	Preconditions *kyvernoConditions `json:"preconditions,omitempty"`
+	Mutate        *kyvernoMutate     `json:"mutate,omitempty"`
+	Validate      *kyvernoValidate   `json:"validate,omitempty"`
+}
+
+type kyvernoMutate struct {
+	ForEach []kyvernoForEach `json:"foreach"`
+}
+
+type kyvernoValidate struct {
+	Message string           `json:"message"`
+	ForEach []kyvernoForEach `json:"foreach"`
+}
+
+type kyvernoForEach struct {
+	List                string             `json:"list"`
+	Context             []kyvernoVariable  `json:"context"`
+	Preconditions       *kyvernoConditions `json:"preconditions,omitempty"`
+	PatchStrategicMerge any                `json:"patchStrategicMerge,omitempty"`
+	Deny                *struct {
+		Conditions kyvernoConditions `json:"conditions"`
+	} `json:"deny,omitempty"`
+}
+
+type kyvernoConditions struct {
+	All []kyvernoCondition `json:"all,omitempty"`
+	Any []kyvernoCondition `json:"any,omitempty"`
+}
+
+type kyvernoCondition struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    any    `json:"value"`
+}
+
+type kyvernoContainerPatch struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+type kyvernoVariable struct {
+	Name     string `json:"name"`
+	Variable struct {
+		JMESPath string `json:"jmesPath"`
+	} `json:"variable"`
+}
+
+func newKyvernoVariable(name, jmesPath string) kyvernoVariable {
+	v := kyvernoVariable{Name: name}
+	v.Variable.JMESPath = jmesPath
+	return v
+}
+
+// runKyverno implements "kyverno": it prints a Kyverno ClusterPolicy that
+// rewrites, denies and rejects pod images exactly as /mutate does.
+func runKyverno(args []string, _ io.Reader, stdout, stderr io.Writer) int {
+	fs, configFile := newFlagSet("kyverno", "", stderr)
+	name := fs.String("name", "ecr-pull-through", "name of the ClusterPolicy")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	srv, err := loadServer(*configFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	srv.warnTargets(stderr, "Kyverno policies")
+	out, err := marshalYAML(srv.kyvernoPolicy(*name))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if _, err := stdout.Write(out); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// kyvernoPolicy builds the ClusterPolicy. For every container it computes,
+// in foreach context variables:
+//
+//	ecrRef    the normalized reference, e.g. docker.io/library/nginx:1.27
+//	ecrName   the repository name the rules match, e.g. docker.io/library/nginx
+//	ecrDomain the registry, e.g. docker.io
+//	ecrRule   "invalid", "cached", the first matching rule (e.g. "rules[0]") or "none"
+//	ecrImage  the image to use
+//
+// The mutate rule patches containers whose ecrImage differs, and a validate
+// rule per deny rule (plus one for invalid references) rejects the pod.
+func (s *server) kyvernoPolicy(name string) kyvernoClusterPolicy {
+	var p kyvernoClusterPolicy
+	p.APIVersion = "kyverno.io/v1"
+	p.Kind = "ClusterPolicy"
+	p.Metadata.Name = name
+	p.Metadata.Annotations = map[string]string{
+		"pod-policies.kyverno.io/autogen-controllers": "none",
+		"policies.kyverno.io/title":                   "Use ECR Pull Through Cache",
+		"policies.kyverno.io/minversion":              "1.10.0",
+		"policies.kyverno.io/description":             "Generated by mutation-webhook kyverno. Rewrites pod images to the ECR pull-through cache " + strings.TrimSuffix(s.ecrRegistryHostname, "/") + " like the ecr-pull-through webhook.",
+	}
+	p.Spec.ValidationFailureAction = "Enforce"
+
+	var mutations []kyvernoForEach
+	for _, field := range podContainerFields {
+		mutations = append(mutations, kyvernoForEach{
+			List:    kyvernoList(field),
+			Context: s.kyvernoContext(),
+			Preconditions: &kyvernoConditions{All: []kyvernoCondition{
+				{Key: "{{ ecrImage }}", Operator: "NotEquals", Value: "{{ element.image }}"},
+			}},
+			PatchStrategicMerge: map[string]any{"spec": map[string]any{
+				field: []kyvernoContainerPatch{{Name: "{{ element.name }}", Image: "{{ ecrImage }}"}},
+			}},
+		})
+	}
+	p.Spec.Rules = append(p.Spec.Rules, kyvernoPodRule("rewrite-images", &kyvernoMutate{ForEach: mutations}, nil))
+
+	p.Spec.Rules = append(p.Spec.Rules, s.kyvernoDenyRule("reject-invalid-images", "invalid", "image is not a valid reference"))
+	for i, r := range s.rules {
+		if r.action == actionDeny {
+			p.Spec.Rules = append(p.Spec.Rules, s.kyvernoDenyRule(fmt.Sprintf("deny-rules-%d", i), fmt.Sprintf("rules[%d]", i),
+				fmt.Sprintf("image denied by %s: %s", r.name, cmp.Or(r.message, "matched deny rule"))))
+		}
+	}
+	return p
+}
+
+// kyvernoDenyRule rejects pods with a container whose ecrRule is rule.
+func (s *server) kyvernoDenyRule(name, rule, message string) kyvernoRule {
+	var validations []kyvernoForEach
+	for _, field := range podContainerFields {
+		v := kyvernoForEach{List: kyvernoList(field), Context: s.kyvernoContext()}
+		v.Deny = &struct {
+			Conditions kyvernoConditions `json:"conditions"`
+		}{kyvernoConditions{Any: []kyvernoCondition{{Key: "{{ ecrRule }}", Operator: "Equals", Value: rule}}}}
+		validations = append(validations, v)
+	}
+	// Braces would be read as Kyverno variables.
+	message = strings.NewReplacer("{{", "{ {", "}}", "} }").Replace(message)
+	return kyvernoPodRule(name, nil, &kyvernoValidate{Message: message, ForEach: validations})
+}
+
+func kyvernoPodRule(name string, mutate *kyvernoMutate, validate *kyvernoValidate) kyvernoRule {
+	return kyvernoRule{
+		Name:  name,
+		Match: map[string]any{"any": []map[string]any{{"resources": map[string]any{"kinds": []string{"Pod"}}}}},
+		Preconditions: &kyvernoConditions{All: []kyvernoCondition{
+			{Key: "{{ request.operation }}", Operator: "AnyIn", Value: []string{"CREATE", "UPDATE"}},
+		}},
+		Mutate:   mutate,
+		Validate: validate,
+	}
+}
+
+func kyvernoList(field string) string {
+	return "request.object.spec." + field + " || `[]`"
+}
+
+// kyvernoContext returns the per-container variables described at
+// kyvernoPolicy.
+func (s *server) kyvernoContext() []kyvernoVariable {
+	ref := fmt.Sprintf("starts_with(element.image, 'localhost/') && element.image || %s",
+		jmesReplace(addDockerHubDomain, "element.image"))
+	for _, r := range s.aliasReplacements() {
+		ref = jmesReplace(r, ref)
+	}
+	ref = jmesReplace(addDockerHubLibrary, ref)
+
+	rule := []string{
+		fmt.Sprintf("!regex_match(%s, element.image) && 'invalid'", jmesString(referencePattern.String())),
+		fmt.Sprintf("starts_with(element.image, %s) && 'cached'", jmesString(s.ecrRegistryHostname)),
+	}
+	var image []string
+	for i, r := range s.rules {
+		key := jmesString(fmt.Sprintf("rules[%d]", i))
+		rule = append(rule, fmt.Sprintf("regex_match(%s, ecrName) && %s", jmesString(r.re.String()), key))
+		if r.action == actionRewrite {
+			image = append(image, fmt.Sprintf("ecrRule == %s && (%s)", key, s.jmesCachedImage(true)))
+		}
+	}
+	rule = append(rule, "'none'")
+	if len(s.registries) > 0 {
+		image = append(image, fmt.Sprintf("ecrRule == 'none' && (%s)", s.jmesCachedImage(false)))
+	}
+	image = append(image, "element.image")
+
+	return []kyvernoVariable{
+		newKyvernoVariable("ecrRef", ref),
+		newKyvernoVariable("ecrName", jmesReplace(trimTagAndDigest, "ecrRef")),
+		newKyvernoVariable("ecrDomain", jmesReplace(trimPath, "ecrRef")),
+		newKyvernoVariable("ecrRule", strings.Join(rule, " || ")),
+		newKyvernoVariable("ecrImage", strings.Join(image, " || ")),
+	}
+}
+
+// jmesCachedImage returns an expression for the pull-through cache path of
+// ecrRef under the prefix of its configured registry. With unconfigured set,
+// registries that are not configured get their default prefix, as for
+// rewrite rules; otherwise the expression is false for them.
+func (s *server) jmesCachedImage(unconfigured bool) string {
+	var alts []string
+	for _, registry := range s.registries {
+		alts = append(alts, fmt.Sprintf("ecrDomain == %s && %s", jmesString(strings.TrimSuffix(registry, "/")),
+			jmesReplace(regexReplacement{regexp.MustCompile(`^[^/]+/`), s.ecrRegistryHostname + s.prefixes[registry]}, "ecrRef")))
+	}
+	if unconfigured {
+		alts = append(alts,
+			fmt.Sprintf("regex_match(%s, ecrDomain) && %s", jmesString(ecrHostnamePattern.String()), jmesReplace(regexReplacement{regexp.MustCompile(`^[^/]+/`), s.ecrRegistryHostname}, "ecrRef")),
+			jmesReplace(regexReplacement{regexp.MustCompile(`^([^/]+)/`), s.ecrRegistryHostname + "${1}/"}, "ecrRef"),
+		)
+	}
+	return strings.Join(alts, " || ")
+}
+
+func jmesReplace(r regexReplacement, src string) string {
+	return fmt.Sprintf("regex_replace_all(%s, %s, %s)", jmesString(r.re.String()), src, jmesString(r.repl))
+}
+
+// jmesString quotes s as a JMESPath raw string literal.
+func jmesString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `\'`) + "'"
+}
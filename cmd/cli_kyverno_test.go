@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+// policyTestImages are valid references covering the normalization cases of
+// parseReference.
+var policyTestImages = []string{
+	"nginx",
+	"nginx:1.27",
+	"nginx@" + testDigest,
+	"nginx:1.27@" + testDigest,
+	"owner/app",
+	"bitnami/redis:7.2",
+	"docker.io/nginx",
+	"docker.io/library/nginx:1.27",
+	"docker.io/owner/app",
+	"localhost",
+	"localhost:5000",
+	"localhost/foo",
+	"localhost:5000/foo:bar",
+	"registry:5000/foo@" + testDigest,
+	"ghcr.io/a/b/c:v1@" + testDigest,
+	"[::1]:5000/foo",
+	"Registry.Example.com/foo",
+	"quay.io/a__b/c-d.e",
+	"a_b/c",
+	"123456789012.dkr.ecr.us-east-1.amazonaws.com/team/app:v1",
+}
+
+func TestNormalizeWithRegexps(t *testing.T) {
+	for _, image := range policyTestImages {
+		t.Run(image, func(t *testing.T) {
+			want, err := parseReference(image)
+			if err != nil {
+				t.Fatalf("parseReference: %v", err)
+			}
+			ref, name, domain := normalizeWithRegexps(image)
+			if ref != want.String() || name != want.Name() || domain != want.Domain {
+				t.Errorf("normalizeWithRegexps(%q) = %q, %q, %q, want %q, %q, %q", image, ref, name, domain, want.String(), want.Name(), want.Domain)
+			}
+		})
+	}
+}
+
+func TestReferencePattern(t *testing.T) {
+	for _, image := range policyTestImages {
+		if !referencePattern.MatchString(image) {
+			t.Errorf("referencePattern does not match valid reference %q", image)
+		}
+	}
+	// Invalid references parseReference rejects, except those only caught by
+	// the name length and registered digest length checks.
+	for _, image := range []string{"", ":tag", "Uppercase", "docker.io/Owner/app", "ghcr.io//app", "ghcr.io/app-", "-bad.io/app", "nginx:", "nginx:-x", "nginx@sha256:abc", "nginx@" + testDigest + "@" + testDigest} {
+		if referencePattern.MatchString(image) {
+			t.Errorf("referencePattern matches invalid reference %q", image)
+		}
+	}
+}
+
+func TestKyvernoCommand(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfig(t, cliTestConfig+`
+  - match: ghcr.io/org/**
+    action: rewrite
+`)
+	code, stdout, stderr := runCLI(t, "", "kyverno", "-config", path, "-name", "pull-through")
+	if code != 0 {
+		t.Fatalf("exit code = %d, stderr = %s", code, stderr)
+	}
+
+	var policy kyvernoClusterPolicy
+	if err := yaml.UnmarshalStrict([]byte(stdout), &policy); err != nil {
+		t.Fatalf("decode policy: %v\n%s", err, stdout)
+	}
+	if policy.Kind != "ClusterPolicy" || policy.Metadata.Name != "pull-through" {
+		t.Errorf("policy = %s %s", policy.Kind, policy.Metadata.Name)
+	}
+	var names []string
+	for _, r := range policy.Spec.Rules {
+		names = append(names, r.Name)
+	}
+	if got, want := strings.Join(names, ","), "rewrite-images,reject-invalid-images,deny-rules-1"; got != want {
+		t.Fatalf("rules = %s, want %s", got, want)
+	}
+
+	rewrite := policy.Spec.Rules[0].Mutate
+	if rewrite == nil || len(rewrite.ForEach) != len(podContainerFields) {
+		t.Fatalf("rewrite-images has no foreach per container field: %+v", rewrite)
+	}
+	vars := map[string]string{}
+	for _, v := range rewrite.ForEach[0].Context {
+		vars[v.Name] = v.Variable.JMESPath
+	}
+	for name, want := range map[string][]string{
+		"ecrRule": {
+			`starts_with(element.image, '123456789012.dkr.ecr.us-east-1.amazonaws.com/') && 'cached'`,
+			`regex_match('^docker\.io/bitnami/[^/]*$', ecrName) && 'rules[0]'`,
+			`regex_match('^ghcr\.io/org/.*$', ecrName) && 'rules[2]' || 'none'`,
+		},
+		"ecrImage": {
+			`ecrRule == 'rules[2]' && (`,
+			`regex_replace_all('^([^/]+)/', ecrRef, '123456789012.dkr.ecr.us-east-1.amazonaws.com/${1}/')`,
+			`ecrRule == 'none' && (ecrDomain == 'docker.io' && regex_replace_all('^[^/]+/', ecrRef, '123456789012.dkr.ecr.us-east-1.amazonaws.com/docker.io/') || ecrDomain == 'quay.io'`,
+			`|| element.image`,
+		},
+	} {
+		for _, w := range want {
+			if !strings.Contains(vars[name], w) {
+				t.Errorf("%s = %s\ndoes not contain %s", name, vars[name], w)
+			}
+		}
+	}
+
+	deny := policy.Spec.Rules[2].Validate
+	if deny == nil || deny.Message != `image denied by rules[1] match "quay.io/licensed/**": not allowed` {
+		t.Fatalf("deny rule = %+v", deny)
+	}
+	if c := deny.ForEach[0].Deny.Conditions.Any[0]; c.Key != "{{ ecrRule }}" || c.Value != "rules[1]" {
+		t.Errorf("deny condition = %+v", c)
+	}
+}
+
+// TestKyvernoPolicyUpToDate fails when kyverno/ecr-pull-through.yaml was not
+// regenerated with "make kyverno" after a change to the generator.
+func TestKyvernoPolicyUpToDate(t *testing.T) {
+	clearConfigEnv(t)
+	want, err := os.ReadFile("../kyverno/ecr-pull-through.yaml")
+	if err != nil {
+		t.Fatalf("read committed policy: %v", err)
+	}
+	code, stdout, stderr := runCLI(t, "", "kyverno", "-config", "../kyverno/registries.yaml")
+	if code != 0 {
+		t.Fatalf("exit code = %d, stderr = %s", code, stderr)
+	}
+	if stdout != string(want) {
+		t.Error("kyverno/ecr-pull-through.yaml is stale, run make kyverno")
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	// celNamePattern finds the repository name of a normalized reference: up
+	// to the last '/' before the digest, then up to the tag.
+	celNamePattern = regexp.MustCompile(`^[^@]*/[^:@]*`)
+	// celDomainPattern finds the registry of a normalized reference.
+	celDomainPattern = regexp.MustCompile(`^[^/]*`)
+)
+
+// normalizeWithCEL normalizes a valid reference like parseReference, using
+// only the matches and finds the generated CEL expressions perform.
+func normalizeWithCEL(image string) (ref, name, domain string) {
+	ref = image
+	if !strings.HasPrefix(image, "localhost/") && addDockerHubDomain.re.MatchString(image) {
+		ref = dockerHubRegistry + image
+	}
+	if addDockerHubLibrary.re.MatchString(ref) {
+		ref = dockerHubRegistry + "library/" + ref[len(dockerHubRegistry):]
+	}
+	return ref, celNamePattern.FindString(ref), celDomainPattern.FindString(ref)
+}
+
+// runAdmissionPolicy implements "admission-policy": it prints a
+// MutatingAdmissionPolicy and its binding that rewrite pod images like
+// /mutate, for clusters that run admission policies instead of the webhook.
+func runAdmissionPolicy(args []string, _ io.Reader, stdout, stderr io.Writer) int {
+	fs, configFile := newFlagSet("admission-policy", "", stderr)
+	name := fs.String("name", "ecr-pull-through", "name of the MutatingAdmissionPolicy and its binding")
+	failurePolicy := fs.String("failure-policy", string(admissionregistrationv1beta1.Ignore), "failure policy: Ignore or Fail")
+	namespaceSelector := fs.String("namespace-selector", "pull-through-enabled=true", "label selector of the namespaces the binding applies to, \"\" for every namespace")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	fp := admissionregistrationv1beta1.FailurePolicyType(*failurePolicy)
+	if fp != admissionregistrationv1beta1.Ignore && fp != admissionregistrationv1beta1.Fail {
+		fmt.Fprintf(stderr, "-failure-policy: %q must be one of Ignore or Fail\n", *failurePolicy)
+		return 2
+	}
+	var selector *metav1.LabelSelector
+	if *namespaceSelector != "" {
+		var err error
+		if selector, err = metav1.ParseToLabelSelector(*namespaceSelector); err != nil {
+			fmt.Fprintf(stderr, "-namespace-selector: %v\n", err)
+			return 2
+		}
+	}
+	srv, err := loadServer(*configFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	srv.warnTargets(stderr, "admission policies")
+	for _, r := range srv.rules {
+		if r.action == actionDeny {
+			fmt.Fprintf(stderr, "warning: admission policies cannot reject images, %s leaves them unchanged\n", r.name)
+		}
+	}
+
+	policy, binding := srv.admissionPolicy(*name, fp, selector)
+	for i, doc := range []any{policy, binding} {
+		out, err := marshalYAML(doc)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		if i > 0 {
+			out = append([]byte("---\n"), out...)
+		}
+		if _, err := stdout.Write(out); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// admissionPolicy builds the MutatingAdmissionPolicy and a binding that
+// applies it to the namespaces matching namespaceSelector, every namespace
+// when it is nil. The policy has one mutation per container field, setting
+// the image of every container to celImage.
+func (s *server) admissionPolicy(name string, failurePolicy admissionregistrationv1beta1.FailurePolicyType, namespaceSelector *metav1.LabelSelector) (*admissionregistrationv1beta1.MutatingAdmissionPolicy, *admissionregistrationv1beta1.MutatingAdmissionPolicyBinding) {
+	typeMeta := func(kind string) metav1.TypeMeta {
+		return metav1.TypeMeta{APIVersion: admissionregistrationv1beta1.SchemeGroupVersion.String(), Kind: kind}
+	}
+
+	policy := &admissionregistrationv1beta1.MutatingAdmissionPolicy{
+		TypeMeta: typeMeta("MutatingAdmissionPolicy"),
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Annotations: map[string]string{
+				"ecr-pull-through/description": "Generated by mutation-webhook admission-policy. Rewrites pod images to the ECR pull-through cache " + strings.TrimSuffix(s.ecrRegistryHostname, "/") + " like the ecr-pull-through webhook.",
+			},
+		},
+		Spec: admissionregistrationv1beta1.MutatingAdmissionPolicySpec{
+			MatchConstraints: &admissionregistrationv1beta1.MatchResources{
+				ResourceRules: []admissionregistrationv1beta1.NamedRuleWithOperations{{
+					RuleWithOperations: admissionregistrationv1beta1.RuleWithOperations{
+						Operations: []admissionregistrationv1beta1.OperationType{admissionregistrationv1beta1.Create, admissionregistrationv1beta1.Update},
+						Rule: admissionregistrationv1beta1.Rule{
+							APIGroups:   []string{""},
+							APIVersions: []string{"v1"},
+							Resources:   []string{"pods"},
+						},
+					},
+				}},
+			},
+			FailurePolicy: &failurePolicy,
+			// Containers added by later mutations are rewritten too.
+			ReinvocationPolicy: admissionregistrationv1beta1.IfNeededReinvocationPolicy,
+		},
+	}
+	for _, field := range podContainerFields {
+		policy.Spec.Mutations = append(policy.Spec.Mutations, admissionregistrationv1beta1.Mutation{
+			PatchType: admissionregistrationv1beta1.PatchTypeApplyConfiguration,
+			ApplyConfiguration: &admissionregistrationv1beta1.ApplyConfiguration{
+				Expression: s.celApplyConfiguration(field),
+			},
+		})
+	}
+
+	binding := &admissionregistrationv1beta1.MutatingAdmissionPolicyBinding{
+		TypeMeta:   typeMeta("MutatingAdmissionPolicyBinding"),
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       admissionregistrationv1beta1.MutatingAdmissionPolicyBindingSpec{PolicyName: name},
+	}
+	if namespaceSelector != nil {
+		binding.Spec.MatchResources = &admissionregistrationv1beta1.MatchResources{NamespaceSelector: namespaceSelector}
+	}
+	return policy, binding
+}
+
+// celApplyConfiguration returns the apply configuration setting the image of
+// every container in the pod spec field. Containers are merged by name, so
+// unchanged images are set to their current value.
+func (s *server) celApplyConfiguration(field string) string {
+	return fmt.Sprintf(`has(object.spec.%[1]s) ? Object{
+  spec: Object.spec{
+    %[1]s: object.spec.%[1]s.map(c, Object.spec.%[1]s{
+      name: c.name,
+      image: %[2]s
+    })
+  }
+} : Object{}`, field, strings.ReplaceAll(s.celImage(), "\n", "\n        "))
+}
+
+// celImage returns an expression for the image of container c, as
+// rewriteImage would return it. It binds, for valid references that do not
+// already use the pull-through cache:
+//
+//	ref    the normalized reference, e.g. docker.io/library/nginx:1.27
+//	name   the repository name the rules match, e.g. docker.io/library/nginx
+//	domain the registry, e.g. docker.io
+//	path   the repository path with tag and digest, e.g. library/nginx:1.27
+//
+// Images matched by skip or deny rules, invalid references and images from
+// unconfigured registries are left unchanged.
+func (s *server) celImage() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "!c.image.matches(%s) || c.image.startsWith(%s) ? c.image :\n",
+		celString(referencePattern.String()), celString(s.ecrRegistryHostname))
+	b.WriteString("cel.bind(img, ")
+	for _, alias := range slices.Sorted(maps.Keys(s.aliases)) {
+		fmt.Fprintf(&b, "c.image.startsWith(%s) ? %s + c.image.substring(%d) : ", celString(alias+"/"), celString(s.aliases[alias]+"/"), len(alias)+1)
+	}
+	fmt.Fprintf(&b, "!c.image.startsWith(\"localhost/\") && c.image.matches(%s) ? %s + c.image : c.image,\n",
+		celString(addDockerHubDomain.re.String()), celString(dockerHubRegistry))
+	fmt.Fprintf(&b, "cel.bind(ref, img.matches(%s) ? %s + img.substring(%d) : img,\n",
+		celString(addDockerHubLibrary.re.String()), celString(dockerHubRegistry+"library/"), len(dockerHubRegistry))
+	fmt.Fprintf(&b, "cel.bind(name, ref.find(%s),\n", celString(celNamePattern.String()))
+	fmt.Fprintf(&b, "cel.bind(domain, ref.find(%s),\n", celString(celDomainPattern.String()))
+	b.WriteString("cel.bind(path, ref.substring(size(domain) + 1),\n")
+	for _, r := range s.rules {
+		image := "c.image"
+		if r.action == actionRewrite {
+			image = "(" + s.celCachedImage(true) + ")"
+		}
+		fmt.Fprintf(&b, "  name.matches(%s) ? %s :\n", celString(r.re.String()), image)
+	}
+	fmt.Fprintf(&b, "  %s)))))", s.celCachedImage(false))
+	return b.String()
+}
+
+// celCachedImage returns an expression for the pull-through cache path of
+// ref under the prefix of its configured registry. With unconfigured set,
+// registries that are not configured get their default prefix, as for
+// rewrite rules; otherwise their images are left unchanged.
+func (s *server) celCachedImage(unconfigured bool) string {
+	var alts []string
+	for _, registry := range s.registries {
+		alts = append(alts, fmt.Sprintf("domain == %s ? %s + path", celString(strings.TrimSuffix(registry, "/")), celString(s.ecrRegistryHostname+s.prefixes[registry])))
+	}
+	if unconfigured {
+		alts = append(alts,
+			fmt.Sprintf("domain.matches(%s) ? %s + path", celString(ecrHostnamePattern.String()), celString(s.ecrRegistryHostname)),
+			celString(s.ecrRegistryHostname)+" + ref")
+	} else {
+		alts = append(alts, "c.image")
+	}
+	return strings.Join(alts, " : ")
+}
+
+// celString quotes s as a CEL string literal, raw unless it contains a
+// double quote or newline.
+func celString(s string) string {
+	if strings.ContainsAny(s, "\"\n") {
+		return strconv.Quote(s)
+	}
+	return `r"` + s + `"`
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"maps"
+	"strings"
+	"testing"
+
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestNormalizeWithCEL(t *testing.T) {
+	for _, image := range policyTestImages {
+		t.Run(image, func(t *testing.T) {
+			want, err := parseReference(image)
+			if err != nil {
+				t.Fatalf("parseReference: %v", err)
+			}
+			ref, name, domain := normalizeWithCEL(image)
+			if ref != want.String() || name != want.Name() || domain != want.Domain {
+				t.Errorf("normalizeWithCEL(%q) = %q, %q, %q, want %q, %q, %q", image, ref, name, domain, want.String(), want.Name(), want.Domain)
+			}
+		})
+	}
+}
+
+func TestCELString(t *testing.T) {
+	for s, want := range map[string]string{
+		`^docker\.io/`: `r"^docker\.io/"`,
+		`say "hi"`:     `"say \"hi\""`,
+	} {
+		if got := celString(s); got != want {
+			t.Errorf("celString(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
+
+func TestAdmissionPolicyCommand(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfig(t, cliTestConfig+`
+  - match: ghcr.io/org/**
+    action: rewrite
+`)
+	code, stdout, stderr := runCLI(t, "", "admission-policy", "-config", path, "-name", "pull-through", "-failure-policy", "Fail")
+	if code != 0 {
+		t.Fatalf("exit code = %d, stderr = %s", code, stderr)
+	}
+	if !strings.Contains(stderr, `warning: admission policies cannot reject images, rules[1] match "quay.io/licensed/**" leaves them unchanged`) {
+		t.Errorf("stderr = %s, want a warning for the deny rule", stderr)
+	}
+
+	docs := strings.Split(stdout, "---\n")
+	if len(docs) != 2 {
+		t.Fatalf("got %d documents, want 2:\n%s", len(docs), stdout)
+	}
+	var policy admissionregistrationv1beta1.MutatingAdmissionPolicy
+	if err := yaml.UnmarshalStrict([]byte(docs[0]), &policy); err != nil {
+		t.Fatalf("decode policy: %v\n%s", err, docs[0])
+	}
+	var binding admissionregistrationv1beta1.MutatingAdmissionPolicyBinding
+	if err := yaml.UnmarshalStrict([]byte(docs[1]), &binding); err != nil {
+		t.Fatalf("decode binding: %v\n%s", err, docs[1])
+	}
+	if policy.Kind != "MutatingAdmissionPolicy" || policy.Name != "pull-through" || policy.APIVersion != "admissionregistration.k8s.io/v1beta1" {
+		t.Errorf("policy = %s %s %s", policy.APIVersion, policy.Kind, policy.Name)
+	}
+	if binding.Kind != "MutatingAdmissionPolicyBinding" || binding.Spec.PolicyName != "pull-through" {
+		t.Errorf("binding = %s %+v", binding.Kind, binding.Spec)
+	}
+	if mr := binding.Spec.MatchResources; mr == nil || mr.NamespaceSelector == nil || !maps.Equal(mr.NamespaceSelector.MatchLabels, map[string]string{"pull-through-enabled": "true"}) {
+		t.Errorf("binding matchResources = %+v, want the pull-through-enabled=true namespace selector", mr)
+	}
+	if fp := policy.Spec.FailurePolicy; fp == nil || *fp != admissionregistrationv1beta1.Fail {
+		t.Errorf("failurePolicy = %v, want Fail", fp)
+	}
+	if got := policy.Spec.MatchConstraints.ResourceRules[0].Resources; len(got) != 1 || got[0] != "pods" {
+		t.Errorf("resources = %v, want [pods]", got)
+	}
+	if len(policy.Spec.Mutations) != len(podContainerFields) {
+		t.Fatalf("got %d mutations, want one per container field", len(policy.Spec.Mutations))
+	}
+
+	for i, m := range policy.Spec.Mutations {
+		field := podContainerFields[i]
+		if m.PatchType != admissionregistrationv1beta1.PatchTypeApplyConfiguration || m.ApplyConfiguration == nil {
+			t.Fatalf("mutation %d = %+v", i, m)
+		}
+		expr := m.ApplyConfiguration.Expression
+		for _, want := range []string{
+			"has(object.spec." + field + ") ? Object{",
+			field + ": object.spec." + field + ".map(c, Object.spec." + field + "{",
+			`c.image.startsWith(r"123456789012.dkr.ecr.us-east-1.amazonaws.com/") ? c.image :`,
+			`cel.bind(ref, img.matches(r"^docker\.io/([^/]+)$") ? r"docker.io/library/" + img.substring(10) : img,`,
+			// Skip and deny rules leave the image unchanged.
+			`name.matches(r"^docker\.io/bitnami/[^/]*$") ? c.image :`,
+			`name.matches(r"^quay\.io/licensed/.*$") ? c.image :`,
+			`name.matches(r"^ghcr\.io/org/.*$") ? (domain == r"docker.io" ? r"123456789012.dkr.ecr.us-east-1.amazonaws.com/docker.io/" + path : ` +
+				`domain == r"quay.io" ? r"123456789012.dkr.ecr.us-east-1.amazonaws.com/quay.io/" + path : ` +
+				`domain.matches(r"^([0-9]{12})\.(dkr\.ecr|dkr\.ecr-fips|dkr-ecr)\.([a-z]{2}(?:-[a-z]+)+-[0-9]+)\.(amazonaws\.com|amazonaws\.com\.cn|on\.aws|on\.amazonwebservices\.com\.cn)$") ? r"123456789012.dkr.ecr.us-east-1.amazonaws.com/" + path : r"123456789012.dkr.ecr.us-east-1.amazonaws.com/" + ref) :`,
+			`domain == r"quay.io" ? r"123456789012.dkr.ecr.us-east-1.amazonaws.com/quay.io/" + path : c.image)))))`,
+		} {
+			if !strings.Contains(expr, want) {
+				t.Errorf("%s expression = %s\ndoes not contain %s", field, expr, want)
+			}
+		}
+	}
+}
+
+func TestAdmissionPolicyCommand_InvalidFailurePolicy(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfig(t, cliTestConfig)
+	code, _, stderr := runCLI(t, "", "admission-policy", "-config", path, "-failure-policy", "Retry")
+	if code != 2 || !strings.Contains(stderr, "must be one of Ignore or Fail") {
+		t.Errorf("exit code = %d, stderr = %s", code, stderr)
+	}
+}
+
+func TestAdmissionPolicyCommand_NamespaceSelector(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfig(t, cliTestConfig)
+
+	binding := func(t *testing.T, selector string) admissionregistrationv1beta1.MutatingAdmissionPolicyBinding {
+		t.Helper()
+		code, stdout, stderr := runCLI(t, "", "admission-policy", "-config", path, "-namespace-selector", selector)
+		if code != 0 {
+			t.Fatalf("exit code = %d, stderr = %s", code, stderr)
+		}
+		var binding admissionregistrationv1beta1.MutatingAdmissionPolicyBinding
+		docs := strings.Split(stdout, "---\n")
+		if err := yaml.UnmarshalStrict([]byte(docs[len(docs)-1]), &binding); err != nil {
+			t.Fatalf("decode binding: %v\n%s", err, stdout)
+		}
+		return binding
+	}
+
+	t.Run("expression", func(t *testing.T) {
+		b := binding(t, "team in (a,b),!legacy")
+		if b.Spec.MatchResources == nil {
+			t.Fatal("binding has no matchResources")
+		}
+		if got, want := metav1.FormatLabelSelector(b.Spec.MatchResources.NamespaceSelector), "!legacy,team in (a,b)"; got != want {
+			t.Errorf("namespaceSelector = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("every namespace", func(t *testing.T) {
+		if b := binding(t, ""); b.Spec.MatchResources != nil {
+			t.Errorf("binding matchResources = %+v, want none", b.Spec.MatchResources)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		code, _, stderr := runCLI(t, "", "admission-policy", "-config", path, "-namespace-selector", "team in")
+		if code != 2 || !strings.Contains(stderr, "-namespace-selector:") {
+			t.Errorf("exit code = %d, stderr = %s", code, stderr)
+		}
+	})
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// runRender implements "render": it rewrites the images of a multi-document
+// Kubernetes YAML stream the way /mutate would and writes the stream back.
+// It reads stdin and writes stdout, so it works as a helm --post-renderer and,
+// because a ResourceList is rewritten item by item, as a kustomize exec
+// KRM function.
+func runRender(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs, configFile := newFlagSet("render", "", stderr)
+	file := fs.String("f", "-", "manifest file to read, - for stdin")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	srv, err := loadServer(*configFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if len(srv.targets) > 1 {
+		fmt.Fprintf(stderr, "warning: render picks targets from metadata.namespace and namespaceTargets, the %s namespace label and annotation are ignored\n", targetKey)
+	}
+
+	in := stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	if err := srv.renderManifests(in, stdout); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// renderManifests rewrites the image fields of every Pod, workload template,
+// CronJob and configured custom resource in the YAML stream r and writes the
+// stream to w. Document order and comments are kept, formatting is
+// normalized. Documents that only hold comments are passed through as they
+// are. Denied and invalid images fail the whole stream, as the webhook would
+// reject those objects.
+func (s *server) renderManifests(r io.Reader, w io.Writer) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	// Each document is decoded on its own: the decoder of a whole stream
+	// attaches the comments of a comment-only document to the one before.
+	var docs []renderDocument
+	for _, chunk := range splitDocuments(data) {
+		var doc yaml.Node
+		if err := yaml.Unmarshal(chunk, &doc); err != nil {
+			return fmt.Errorf("parsing manifests: document %d: %w", len(docs)+1, err)
+		}
+		if len(doc.Content) == 0 || doc.Content[0].Tag == "!!null" {
+			if len(bytes.TrimSpace(chunk)) > 0 {
+				docs = append(docs, renderDocument{raw: chunk})
+			}
+			continue
+		}
+		docs = append(docs, renderDocument{node: &doc})
+	}
+
+	var errs []error
+	for i, doc := range docs {
+		if doc.node == nil {
+			continue
+		}
+		if err := s.renderObject(doc.node.Content[0]); err != nil {
+			errs = append(errs, fmt.Errorf("document %d: %w", i+1, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	for i, doc := range docs {
+		if i > 0 {
+			if _, err := io.WriteString(w, "---\n"); err != nil {
+				return err
+			}
+		}
+		if doc.node == nil {
+			if _, err := w.Write(doc.raw); err != nil {
+				return err
+			}
+			continue
+		}
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(doc.node); err != nil {
+			return err
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderDocument is a document of the rendered stream: a decoded node, or
+// the raw text of a document that only holds comments.
+type renderDocument struct {
+	node *yaml.Node
+	raw  []byte
+}
+
+// splitDocuments splits a YAML stream at its "---" document markers. Text
+// after a marker on the same line, such as a comment, starts the next
+// document. Every document ends with a newline.
+func splitDocuments(data []byte) [][]byte {
+	var docs [][]byte
+	var doc []byte
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		text := strings.TrimRight(string(line), "\r\n")
+		if rest, ok := strings.CutPrefix(text, "---"); ok && (rest == "" || rest[0] == ' ' || rest[0] == '\t') {
+			docs = append(docs, doc)
+			doc = nil
+			if rest = strings.TrimSpace(rest); rest != "" {
+				doc = append(doc, rest+"\n"...)
+			}
+			continue
+		}
+		doc = append(doc, line...)
+	}
+	if len(doc) > 0 && doc[len(doc)-1] != '\n' {
+		doc = append(doc, '\n')
+	}
+	return append(docs, doc)
+}
+
+// renderObject rewrites the images of one object to the target
+// namespaceTargets maps its metadata.namespace to, descending into the items
+// of a List or ResourceList.
+func (s *server) renderObject(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	var raw any
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+	obj, _ := raw.(map[string]any)
+	apiVersion, _ := obj["apiVersion"].(string)
+	kind, _ := obj["kind"].(string)
+	if kind == "" {
+		return nil
+	}
+
+	if kind == "List" || kind == "ResourceList" {
+		items := lookupNode(node, []string{"items"})
+		if items == nil || items.Kind != yaml.SequenceNode {
+			return nil
+		}
+		var errs []error
+		for i, item := range items.Content {
+			if err := s.renderObject(item); err != nil {
+				errs = append(errs, fmt.Errorf("items[%d]: %w", i, err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	group, version, ok := strings.Cut(apiVersion, "/")
+	if !ok {
+		group, version = "", apiVersion
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	_, fields, err := s.imageFields(metav1.GroupVersionKind{Group: group, Version: version, Kind: kind}, data)
+	if err != nil {
+		return err
+	}
+
+	name, namespace := kind, ""
+	if meta, ok := obj["metadata"].(map[string]any); ok {
+		if n, ok := meta["name"].(string); ok {
+			name += "/" + n
+		}
+		namespace, _ = meta["namespace"].(string)
+	}
+	target := s.targets[s.namespaceTarget(namespace)]
+	var errs []error
+	for _, field := range fields {
+		newImage, ok, err := s.rewriteImageAt(field.image, target)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", name, field.label(), err))
+			continue
+		}
+		if !ok {
+			continue
+		}
+		segments, err := parsePointer(field.path)
+		if err != nil {
+			return err
+		}
+		if target := lookupNode(node, segments); target != nil && target.Kind == yaml.ScalarNode {
+			target.Value = newImage
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// lookupNode follows the unescaped JSON pointer segments from node, returning
+// nil when the path does not exist.
+func lookupNode(node *yaml.Node, segments []string) *yaml.Node {
+	for _, seg := range segments {
+		for node.Kind == yaml.AliasNode {
+			node = node.Alias
+		}
+		switch node.Kind {
+		case yaml.MappingNode:
+			var next *yaml.Node
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == seg {
+					next = node.Content[i+1]
+					break
+				}
+			}
+			if next == nil {
+				return nil
+			}
+			node = next
+		case yaml.SequenceNode:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(node.Content) {
+				return nil
+			}
+			node = node.Content[i]
+		default:
+			return nil
+		}
+	}
+	return node
+}
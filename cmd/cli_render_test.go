@@ -0,0 +1,284 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const renderTestConfig = cliTestConfig + `
+customResources:
+  - group: argoproj.io
+    kind: Rollout
+    paths: [/spec/template/spec/containers/*/image]
+`
+
+const cachedNginx = "123456789012.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/nginx:1.27"
+
+func TestRenderCommand(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfig(t, renderTestConfig)
+
+	in := `# Source: chart/templates/pod.yaml
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web # the web pod
+spec:
+  initContainers:
+    - name: init
+      image: "busybox"
+  containers:
+    - name: app
+      image: nginx:1.27 # pinned
+    - name: side
+      image: ghcr.io/org/side
+---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: nightly
+spec:
+  schedule: "@daily"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - name: job
+              image: nginx:1.27
+---
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cfg
+data:
+  image: nginx:1.27
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+metadata:
+  name: canary
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          image: nginx:1.27
+`
+	want := `# Source: chart/templates/pod.yaml
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web # the web pod
+spec:
+  initContainers:
+    - name: init
+      image: "123456789012.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/busybox"
+  containers:
+    - name: app
+      image: ` + cachedNginx + ` # pinned
+    - name: side
+      image: ghcr.io/org/side
+---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: nightly
+spec:
+  schedule: "@daily"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - name: job
+              image: ` + cachedNginx + `
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cfg
+data:
+  image: nginx:1.27
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+metadata:
+  name: canary
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          image: ` + cachedNginx + `
+`
+	code, stdout, stderr := runCLI(t, in, "render", "-config", path)
+	if code != 0 {
+		t.Fatalf("exit code = %d, stderr = %s", code, stderr)
+	}
+	if stdout != want {
+		t.Errorf("output:\n%s\nwant:\n%s", stdout, want)
+	}
+}
+
+func TestRenderCommand_ResourceList(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfig(t, cliTestConfig)
+
+	in := `apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+items:
+  - apiVersion: apps/v1
+    kind: Deployment
+    metadata:
+      name: web
+    spec:
+      template:
+        spec:
+          containers:
+            - name: app
+              image: nginx:1.27
+functionConfig:
+  apiVersion: v1
+  kind: ConfigMap
+`
+	code, stdout, stderr := runCLI(t, in, "render", "-config", path)
+	if code != 0 {
+		t.Fatalf("exit code = %d, stderr = %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "image: "+cachedNginx) || !strings.Contains(stdout, "kind: ResourceList") {
+		t.Errorf("output:\n%s", stdout)
+	}
+}
+
+func TestRenderCommand_Targets(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfig(t, cliTestConfig+`
+targets:
+  - name: team-a
+    awsAccountId: "111111111111"
+    awsRegion: eu-west-1
+namespaceTargets:
+  payments: team-a
+`)
+
+	in := `apiVersion: v1
+kind: Pod
+metadata:
+  name: pay
+  namespace: payments
+spec:
+  containers:
+    - name: app
+      image: nginx:1.27
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  namespace: apps
+spec:
+  containers:
+    - name: app
+      image: nginx:1.27
+`
+	code, stdout, stderr := runCLI(t, in, "render", "-config", path)
+	if code != 0 {
+		t.Fatalf("exit code = %d, stderr = %s", code, stderr)
+	}
+	docs := strings.Split(stdout, "---\n")
+	if len(docs) != 2 {
+		t.Fatalf("got %d documents, want 2:\n%s", len(docs), stdout)
+	}
+	if want := "image: 111111111111.dkr.ecr.eu-west-1.amazonaws.com/docker.io/library/nginx:1.27"; !strings.Contains(docs[0], want) {
+		t.Errorf("payments pod does not contain %q:\n%s", want, docs[0])
+	}
+	if want := "image: " + cachedNginx; !strings.Contains(docs[1], want) {
+		t.Errorf("apps pod does not contain %q:\n%s", want, docs[1])
+	}
+	if !strings.Contains(stderr, "warning: render picks targets from metadata.namespace") {
+		t.Errorf("stderr = %s, want a warning about namespace labels", stderr)
+	}
+}
+
+func TestRenderCommand_CommentOnlyDocuments(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfig(t, cliTestConfig)
+
+	in := `# Source: chart/templates/disabled.yaml
+# rendered nothing
+---
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  containers:
+    - name: app
+      image: nginx:1.27
+---
+# Source: chart/templates/notes.yaml
+`
+	want := `# Source: chart/templates/disabled.yaml
+# rendered nothing
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  containers:
+    - name: app
+      image: ` + cachedNginx + `
+---
+# Source: chart/templates/notes.yaml
+`
+	code, stdout, stderr := runCLI(t, in, "render", "-config", path)
+	if code != 0 {
+		t.Fatalf("exit code = %d, stderr = %s", code, stderr)
+	}
+	if stdout != want {
+		t.Errorf("output:\n%s\nwant:\n%s", stdout, want)
+	}
+}
+
+func TestRenderCommand_Rejected(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfig(t, cliTestConfig)
+
+	in := `apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  containers:
+    - name: app
+      image: quay.io/licensed/app
+    - name: bad
+      image: Invalid:Image
+`
+	code, stdout, stderr := runCLI(t, in, "render", "-config", path)
+	if code != 1 {
+		t.Fatalf("exit code = %d, want 1", code)
+	}
+	if stdout != "" {
+		t.Errorf("expected no output, got:\n%s", stdout)
+	}
+	for _, want := range []string{`document 1: Pod/web container "app": image "quay.io/licensed/app" denied`, `Pod/web container "bad"`} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("stderr %q does not contain %q", stderr, want)
+		}
+	}
+}
+
+func TestRenderCommand_InvalidYAML(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfig(t, cliTestConfig)
+
+	code, _, stderr := runCLI(t, "kind: [", "render", "-config", path)
+	if code != 1 || !strings.Contains(stderr, "parsing manifests") {
+		t.Errorf("exit code = %d, stderr = %q", code, stderr)
+	}
+}
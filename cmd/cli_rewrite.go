@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// rewriteResult is the outcome for one image of the rewrite command.
+type rewriteResult struct {
+	Image     string `json:"image"`
+	Action    string `json:"action"` // rewrite, skip, deny or invalid
+	Rewritten string `json:"rewritten,omitempty"`
+	Rule      string `json:"rule,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// runRewrite implements "rewrite": it evaluates image references given as
+// arguments, or one per line on stdin, exactly as the webhook would.
+func runRewrite(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs, configFile := newFlagSet("rewrite", "[image...]", stderr)
+	output := fs.String("o", "text", "output format: text or json")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if err := checkOutputFormat(*output); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	srv, err := loadServer(*configFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	images := fs.Args()
+	if len(images) == 0 {
+		if images, err = readImages(stdin); err != nil {
+			fmt.Fprintf(stderr, "reading stdin: %v\n", err)
+			return 1
+		}
+	}
+	results := make([]rewriteResult, 0, len(images))
+	for _, image := range images {
+		results = append(results, srv.explainImage(image))
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(results)
+	} else {
+		err = writeRewriteTable(stdout, results)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// explainImage evaluates image and describes the decision.
+func (s *server) explainImage(image string) rewriteResult {
+	d, err := s.evaluateImage(image)
+	if err != nil {
+		return rewriteResult{Image: image, Action: "invalid", Reason: err.Error()}
+	}
+	return rewriteResult{Image: image, Action: string(d.Action), Rewritten: d.Image, Rule: d.Rule, Reason: d.Reason}
+}
+
+// readImages reads one image per line, ignoring blank lines and # comments.
+func readImages(r io.Reader) ([]string, error) {
+	var images []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		images = append(images, line)
+	}
+	return images, scanner.Err()
+}
+
+func writeRewriteTable(w io.Writer, results []rewriteResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "IMAGE\tACTION\tRESULT\tRULE\tREASON")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Image, r.Action, orDash(r.Rewritten), orDash(r.Rule), r.Reason)
+	}
+	return tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
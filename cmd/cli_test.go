@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const cliTestConfig = `
+awsAccountId: "123456789012"
+awsRegion: us-east-1
+registries:
+  - docker.io
+  - quay.io
+rules:
+  - match: docker.io/bitnami/*
+    action: skip
+  - match: quay.io/licensed/**
+    action: deny
+    message: not allowed
+`
+
+// runCLI runs a subcommand with stdin and returns its exit code and output.
+func runCLI(t *testing.T, stdin string, args ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	code = runCommand(args, strings.NewReader(stdin), &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+func TestRunCommand_Unknown(t *testing.T) {
+	code, _, stderr := runCLI(t, "", "frobnicate")
+	if code != 2 {
+		t.Errorf("exit code = %d, want 2", code)
+	}
+	if !strings.Contains(stderr, `unknown command "frobnicate"`) || !strings.Contains(stderr, "rewrite") {
+		t.Errorf("stderr = %q", stderr)
+	}
+}
+
+func TestRewriteCommand(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfig(t, cliTestConfig)
+
+	t.Run("json", func(t *testing.T) {
+		code, stdout, stderr := runCLI(t, "", "rewrite", "-config", path, "-o", "json",
+			"nginx:1.27", "bitnami/redis", "quay.io/licensed/app", "ghcr.io/org/app", "Invalid:Image")
+		if code != 0 {
+			t.Fatalf("exit code = %d, stderr = %s", code, stderr)
+		}
+		var got []rewriteResult
+		if err := json.Unmarshal([]byte(stdout), &got); err != nil {
+			t.Fatalf("decode output: %v\n%s", err, stdout)
+		}
+		want := []rewriteResult{
+			{Image: "nginx:1.27", Action: "rewrite", Rewritten: "123456789012.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/nginx:1.27", Reason: "registry docker.io is configured"},
+			{Image: "bitnami/redis", Action: "skip", Rule: `rules[0] match "docker.io/bitnami/*"`, Reason: "matched skip rule"},
+			{Image: "quay.io/licensed/app", Action: "deny", Rule: `rules[1] match "quay.io/licensed/**"`, Reason: "not allowed"},
+			{Image: "ghcr.io/org/app", Action: "skip", Reason: "registry ghcr.io is not configured"},
+		}
+		if len(got) != len(want)+1 {
+			t.Fatalf("got %d results, want %d", len(got), len(want)+1)
+		}
+		for i, w := range want {
+			if got[i] != w {
+				t.Errorf("result %d = %+v, want %+v", i, got[i], w)
+			}
+		}
+		if last := got[len(want)]; last.Action != "invalid" || last.Reason == "" {
+			t.Errorf("invalid image result = %+v", last)
+		}
+	})
+
+	t.Run("text from stdin", func(t *testing.T) {
+		code, stdout, stderr := runCLI(t, "# images\nnginx:1.27\n\nghcr.io/org/app\n", "rewrite", "-config", path)
+		if code != 0 {
+			t.Fatalf("exit code = %d, stderr = %s", code, stderr)
+		}
+		lines := strings.Split(strings.TrimSpace(stdout), "\n")
+		if len(lines) != 3 {
+			t.Fatalf("got %d lines, want a header and 2 rows:\n%s", len(lines), stdout)
+		}
+		if fields := strings.Fields(lines[1]); fields[0] != "nginx:1.27" || fields[1] != "rewrite" ||
+			fields[2] != "123456789012.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/nginx:1.27" || fields[3] != "-" {
+			t.Errorf("row = %q", lines[1])
+		}
+		if fields := strings.Fields(lines[2]); fields[1] != "skip" || fields[2] != "-" {
+			t.Errorf("row = %q", lines[2])
+		}
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		code, _, stderr := runCLI(t, "", "rewrite", "-config", writeConfig(t, "awsRegion: us-east-1\n"), "nginx")
+		if code != 1 || !strings.Contains(stderr, "invalid config") {
+			t.Errorf("exit code = %d, stderr = %q", code, stderr)
+		}
+	})
+
+	t.Run("invalid output format", func(t *testing.T) {
+		code, _, stderr := runCLI(t, "", "rewrite", "-config", path, "-o", "yaml", "nginx")
+		if code != 2 || !strings.Contains(stderr, "must be one of text or json") {
+			t.Errorf("exit code = %d, stderr = %q", code, stderr)
+		}
+	})
+}
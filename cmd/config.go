@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// defaultConfigPath is where manifests/bundle.yaml and the Helm chart mount
+// the registries.yaml ConfigMap.
+const defaultConfigPath = "/etc/ecr-pull-through/registries.yaml"
+
+var (
+	accountIDPattern = regexp.MustCompile(`^[0-9]{12}$`)
+	regionPattern    = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+	hostnamePattern  = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?(:[0-9]+)?$`)
+	// ecrPrefixPattern is the repository prefix format accepted by ECR
+	// pull-through cache rules.
+	ecrPrefixPattern = regexp.MustCompile(`^(?:[a-z0-9]+(?:[._-][a-z0-9]+)*/)*[a-z0-9]+(?:[._-][a-z0-9]+)*$`)
+)
+
+// maxECRPrefixLength is the longest repository prefix ECR accepts for a
+// pull-through cache rule.
+const maxECRPrefixLength = 30
+
+// config is the schema of the registries.yaml file:
+//
+//	awsAccountId: "123456789012" # required
+//	awsRegion: us-east-1         # required
+//	ecrEndpoint: standard        # or fips or dualstack
+//	ecrHostname: ""              # replaces the hostname derived from the above
+//	registries:                  # optional, defaults to [docker.io]
+//	  - ghcr.io                  # cached under the "ghcr.io" prefix
+//	  - host: docker.io
+//	    prefix: dockerhub        # ECR pull-through rule prefix, defaults to host
+//	registryAliases:             # optional, alias -> canonical registry, see
+//	  mirror.gcr.io: docker.io   # config.registryAliases for the defaults
+//	rules:                       # optional, see ruleConfig
+//	  - match: docker.io/bitnami/*
+//	    action: skip
+//	customResources:             # optional, see customResourceConfig
+//	  - group: argoproj.io
+//	    kind: Rollout
+//	    paths: [/spec/template/spec/containers/*/image]
+//	dryRun: false                # report rewrites without patching
+//	dryRunNamespaces:            # dry run only in these namespaces (globs)
+//	  - staging-*
+//	validationScope: configured  # /validate rejects: configured registries or all non-ECR
+//	targets:                     # optional, see targetConfig
+//	  - name: team-a
+//	    awsAccountId: "111111111111"
+//	    awsRegion: eu-west-1
+//	namespaceTargets:            # namespace -> target name
+//	  payments: team-a
+//	pinDigests:                  # optional, see pinDigestsConfig
+//	  enabled: true
+//
+// awsAccountId, awsRegion, registries and dryRun can be overridden with the
+// matching ECR_* environment variable.
+type config struct {
+	AWSAccountID string           `json:"awsAccountId"`
+	AWSRegion    string           `json:"awsRegion"`
+	Registries   []registryConfig `json:"registries,omitempty"`
+	Rules        []ruleConfig     `json:"rules,omitempty"`
+
+	RegistryAliases map[string]string `json:"registryAliases,omitempty"`
+
+	// ECREndpoint and the partition of the region, see awsPartitions, make
+	// up the hostname of every target without an ECRHostname.
+	ECREndpoint ecrEndpoint `json:"ecrEndpoint,omitempty"`
+	ECRHostname string      `json:"ecrHostname,omitempty"`
+
+	CustomResources []customResourceConfig `json:"customResources,omitempty"`
+
+	DryRun           bool     `json:"dryRun,omitempty"`
+	DryRunNamespaces []string `json:"dryRunNamespaces,omitempty"`
+
+	ValidationScope validationScope `json:"validationScope,omitempty"`
+
+	Targets          []targetConfig    `json:"targets,omitempty"`
+	NamespaceTargets map[string]string `json:"namespaceTargets,omitempty"`
+
+	PinDigests pinDigestsConfig `json:"pinDigests,omitzero"`
+}
+
+// registryConfig is an upstream registry and the repository prefix of its
+// ECR pull-through cache rule. It is written either as a plain hostname or
+// as an object with host and prefix.
+type registryConfig struct {
+	Host   string `json:"host"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+func (r *registryConfig) UnmarshalJSON(data []byte) error {
+	var host string
+	if err := json.Unmarshal(data, &host); err == nil {
+		*r = registryConfig{Host: host}
+		return nil
+	}
+	type plain registryConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*plain)(r))
+}
+
+func (r registryConfig) MarshalJSON() ([]byte, error) {
+	if r.Prefix == "" {
+		return json.Marshal(r.Host)
+	}
+	type plain registryConfig
+	return json.Marshal(plain(r))
+}
+
+// parseRegistryConfig parses the ECR_REGISTRIES form "host" or "host=prefix".
+func parseRegistryConfig(s string) registryConfig {
+	host, prefix, _ := strings.Cut(s, "=")
+	return registryConfig{Host: strings.TrimSpace(host), Prefix: strings.TrimSpace(prefix)}
+}
+
+// configPath returns the config file location and whether it was explicitly
+// requested through ECR_CONFIG_FILE. Only an explicitly requested file must exist.
+func configPath() (string, bool) {
+	if p := os.Getenv("ECR_CONFIG_FILE"); p != "" {
+		return p, true
+	}
+	return defaultConfigPath, false
+}
+
+// loadConfig reads the config file at path, applies environment overrides and
+// validates the result. A missing file is tolerated unless required is set, so
+// deployments configured purely through environment variables keep working.
+func loadConfig(path string, required bool) (*config, error) {
+	cfg := &config{}
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	case errors.Is(err, os.ErrNotExist) && !required:
+	default:
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	cfg.normalize()
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides file values with ECR_AWS_ACCOUNT_ID, ECR_AWS_REGION,
+// ECR_REGISTRIES (comma separated "host" or "host=prefix") and ECR_DRY_RUN
+// when they are set.
+func (c *config) applyEnv() error {
+	if v := os.Getenv("ECR_AWS_ACCOUNT_ID"); v != "" {
+		c.AWSAccountID = v
+	}
+	if v := os.Getenv("ECR_AWS_REGION"); v != "" {
+		c.AWSRegion = v
+	}
+	if raw := os.Getenv("ECR_REGISTRIES"); raw != "" {
+		var registries []registryConfig
+		for r := range strings.SplitSeq(raw, ",") {
+			if r = strings.TrimSpace(r); r != "" {
+				registries = append(registries, parseRegistryConfig(r))
+			}
+		}
+		c.Registries = registries
+	}
+	if v := os.Getenv("ECR_DRY_RUN"); v != "" {
+		dryRun, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("ECR_DRY_RUN: %q is not a boolean", v)
+		}
+		c.DryRun = dryRun
+	}
+	return nil
+}
+
+// normalize trims whitespace and trailing slashes and fills in defaults.
+func (c *config) normalize() {
+	c.AWSAccountID = strings.TrimSpace(c.AWSAccountID)
+	c.AWSRegion = strings.TrimSpace(c.AWSRegion)
+	c.ECRHostname = strings.TrimRight(strings.TrimSpace(c.ECRHostname), "/")
+	for i, t := range c.Targets {
+		c.Targets[i].AWSAccountID = strings.TrimSpace(t.AWSAccountID)
+		c.Targets[i].AWSRegion = strings.TrimSpace(t.AWSRegion)
+		c.Targets[i].ECRHostname = strings.TrimRight(strings.TrimSpace(t.ECRHostname), "/")
+	}
+	for i, r := range c.Registries {
+		c.Registries[i].Host = strings.TrimRight(strings.TrimSpace(r.Host), "/")
+		c.Registries[i].Prefix = strings.Trim(strings.TrimSpace(r.Prefix), "/")
+	}
+	if c.RegistryAliases != nil {
+		aliases := make(map[string]string, len(c.RegistryAliases))
+		for alias, canonical := range c.RegistryAliases {
+			aliases[strings.TrimRight(strings.TrimSpace(alias), "/")] = strings.TrimRight(strings.TrimSpace(canonical), "/")
+		}
+		c.RegistryAliases = aliases
+	}
+	if len(c.Registries) == 0 {
+		c.Registries = []registryConfig{{Host: strings.TrimSuffix(dockerHubRegistry, "/")}}
+	}
+}
+
+// validate reports every invalid field, each error prefixed with its key.
+func (c *config) validate() error {
+	var errs []error
+	switch {
+	case c.AWSAccountID == "":
+		errs = append(errs, errors.New("awsAccountId: is required (or set ECR_AWS_ACCOUNT_ID)"))
+	case !accountIDPattern.MatchString(c.AWSAccountID):
+		errs = append(errs, fmt.Errorf("awsAccountId: %q must be a 12-digit AWS account ID", c.AWSAccountID))
+	}
+	switch {
+	case c.AWSRegion == "":
+		errs = append(errs, errors.New("awsRegion: is required (or set ECR_AWS_REGION)"))
+	case !regionPattern.MatchString(c.AWSRegion):
+		errs = append(errs, fmt.Errorf("awsRegion: %q is not a valid AWS region", c.AWSRegion))
+	}
+	switch c.ECREndpoint {
+	case "", endpointStandard, endpointFIPS, endpointDualStack:
+		if err := c.defaultTarget().validateHostname("", c.ECREndpoint); err != nil {
+			errs = append(errs, err)
+		}
+	default:
+		errs = append(errs, fmt.Errorf("ecrEndpoint: %q must be one of standard, fips or dualstack", c.ECREndpoint))
+	}
+	seen := map[string]bool{}
+	for i, r := range c.Registries {
+		switch {
+		case !hostnamePattern.MatchString(r.Host):
+			errs = append(errs, fmt.Errorf("registries[%d]: %q is not a valid registry hostname", i, r.Host))
+		case seen[r.Host]:
+			errs = append(errs, fmt.Errorf("registries[%d]: %q is listed more than once", i, r.Host))
+		}
+		seen[r.Host] = true
+		if r.Prefix != "" && (!ecrPrefixPattern.MatchString(r.Prefix) || len(r.Prefix) > maxECRPrefixLength) {
+			errs = append(errs, fmt.Errorf("registries[%d].prefix: %q is not a valid ECR repository prefix", i, r.Prefix))
+		}
+	}
+	if err := c.validateRegistryAliases(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := compileRules(c.Rules); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := compileCustomResources(c.CustomResources); err != nil {
+		errs = append(errs, err)
+	}
+	switch c.ValidationScope {
+	case "", scopeConfigured, scopeAll:
+	default:
+		errs = append(errs, fmt.Errorf("validationScope: %q must be one of configured or all", c.ValidationScope))
+	}
+	if err := c.validateTargets(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.PinDigests.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	for i, ns := range c.DryRunNamespaces {
+		if _, err := path.Match(ns, ""); err != nil || ns == "" {
+			errs = append(errs, fmt.Errorf("dryRunNamespaces[%d]: %q is not a valid namespace pattern", i, ns))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ConfigReloader serves requests from a server built from the config file and
+// swaps in a new one whenever the file changes or the process receives SIGHUP.
+// A config that fails validation is logged and the running one is kept.
+type ConfigReloader struct {
+	mu       sync.Mutex
+	path     string
+	required bool
+	modTime  time.Time
+	current  atomic.Pointer[server]
+	// namespaces is handed to every server built, see server.namespaces.
+	namespaces namespaceLookup
+}
+
+func newConfigReloader(path string, required bool) (*ConfigReloader, error) {
+	cr := &ConfigReloader{path: path, required: required}
+	if stat, err := os.Stat(path); err == nil {
+		cr.modTime = stat.ModTime()
+	}
+	cfg, err := loadConfig(path, required)
+	if err != nil {
+		return nil, err
+	}
+	srv, err := newServerFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cr.current.Store(srv)
+	return cr, nil
+}
+
+// Server returns the server built from the most recent valid config.
+func (cr *ConfigReloader) Server() *server {
+	return cr.current.Load()
+}
+
+// SetNamespaceLookup makes the current and all later servers select ECR
+// targets from namespace labels and annotations through lookup.
+func (cr *ConfigReloader) SetNamespaceLookup(lookup namespaceLookup) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.namespaces = lookup
+	srv := *cr.current.Load()
+	srv.namespaces = lookup
+	cr.current.Store(&srv)
+}
+
+func (cr *ConfigReloader) handleMutate(w http.ResponseWriter, r *http.Request) {
+	cr.Server().handleMutate(w, r)
+}
+
+func (cr *ConfigReloader) handleValidate(w http.ResponseWriter, r *http.Request) {
+	cr.Server().handleValidate(w, r)
+}
+
+// Reload loads and validates the config file and atomically replaces the
+// running server. On error the previous server stays in place.
+func (cr *ConfigReloader) Reload() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if stat, err := os.Stat(cr.path); err == nil {
+		cr.modTime = stat.ModTime()
+	}
+	return cr.reload()
+}
+
+// reloadIfChanged reloads the config when the file modification time moved.
+// Kubernetes updates mounted ConfigMaps by swapping a symlink, which os.Stat
+// follows, so this also picks up ConfigMap edits.
+func (cr *ConfigReloader) reloadIfChanged() error {
+	stat, err := os.Stat(cr.path)
+	if err != nil {
+		if os.IsNotExist(err) && !cr.required {
+			return nil
+		}
+		return fmt.Errorf("failed checking config file modification time: %w", err)
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if stat.ModTime().Equal(cr.modTime) {
+		return nil
+	}
+	cr.modTime = stat.ModTime()
+	return cr.reload()
+}
+
+func (cr *ConfigReloader) reload() error {
+	cfg, err := loadConfig(cr.path, cr.required)
+	if err != nil {
+		return err
+	}
+	srv, err := newServerFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+	srv.namespaces = cr.namespaces
+	old := cr.current.Swap(srv)
+	if changes := diffConfig(old.cfg, cfg); len(changes) > 0 {
+		slog.Info("configuration reloaded", "changes", changes)
+	} else {
+		slog.Info("configuration reloaded", "changes", "none")
+	}
+	return nil
+}
+
+// Watch polls the config file every interval and reloads on SIGHUP until ctx
+// is cancelled.
+func (cr *ConfigReloader) Watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("received SIGHUP, reloading configuration")
+			err = cr.Reload()
+		case <-ticker.C:
+			err = cr.reloadIfChanged()
+		}
+		if err != nil {
+			slog.Error("failed to reload configuration, keeping previous one", "error", err)
+		}
+	}
+}
+
+// diffConfig describes how two configs differ, one entry per changed
+// top-level key. List-valued keys report added and removed elements.
+func diffConfig(prev, next *config) []string {
+	oldFields, newFields := configFields(prev), configFields(next)
+
+	keys := make([]string, 0, len(oldFields)+len(newFields))
+	for k := range oldFields {
+		keys = append(keys, k)
+	}
+	for k := range newFields {
+		if _, ok := oldFields[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	var changes []string
+	for _, k := range keys {
+		o, n := oldFields[k], newFields[k]
+		if string(o) == string(n) {
+			continue
+		}
+		var oldList, newList []json.RawMessage
+		if json.Unmarshal(o, &oldList) == nil && json.Unmarshal(n, &newList) == nil {
+			for _, e := range newList {
+				if !containsRaw(oldList, e) {
+					changes = append(changes, fmt.Sprintf("%s: +%s", k, e))
+				}
+			}
+			for _, e := range oldList {
+				if !containsRaw(newList, e) {
+					changes = append(changes, fmt.Sprintf("%s: -%s", k, e))
+				}
+			}
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", k, orNull(o), orNull(n)))
+	}
+	return changes
+}
+
+func configFields(c *config) map[string]json.RawMessage {
+	fields := map[string]json.RawMessage{}
+	if c == nil {
+		return fields
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fields
+	}
+	_ = json.Unmarshal(data, &fields)
+	return fields
+}
+
+func containsRaw(list []json.RawMessage, v json.RawMessage) bool {
+	return slices.ContainsFunc(list, func(e json.RawMessage) bool { return string(e) == string(v) })
+}
+
+func orNull(v json.RawMessage) string {
+	if v == nil {
+		return "null"
+	}
+	return string(v)
+}
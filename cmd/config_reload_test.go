@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// rewriteConfig replaces the config file content and bumps its modification
+// time so reloadIfChanged notices the change.
+func rewriteConfig(t *testing.T, path, content string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+}
+
+func TestConfigReloader(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfig(t, "awsAccountId: \"123456789012\"\nawsRegion: us-east-1\nregistries: [docker.io]\n")
+	cr, err := newConfigReloader(path, true)
+	if err != nil {
+		t.Fatalf("newConfigReloader: %v", err)
+	}
+	first := cr.Server()
+
+	t.Run("unchanged file keeps server", func(t *testing.T) {
+		if err := cr.reloadIfChanged(); err != nil {
+			t.Fatalf("reloadIfChanged: %v", err)
+		}
+		if cr.Server() != first {
+			t.Fatal("server swapped although the file did not change")
+		}
+	})
+
+	t.Run("changed file swaps server", func(t *testing.T) {
+		rewriteConfig(t, path, "awsAccountId: \"123456789012\"\nawsRegion: us-east-1\nregistries: [docker.io, ghcr.io]\n", time.Now().Add(time.Minute))
+		if err := cr.reloadIfChanged(); err != nil {
+			t.Fatalf("reloadIfChanged: %v", err)
+		}
+		if want := []string{"docker.io/", "ghcr.io/"}; !slices.Equal(cr.Server().registries, want) {
+			t.Fatalf("registries = %v, want %v", cr.Server().registries, want)
+		}
+	})
+
+	t.Run("invalid file keeps previous server", func(t *testing.T) {
+		before := cr.Server()
+		rewriteConfig(t, path, "awsAccountId: \"123456789012\"\nawsRegion: nowhere\n", time.Now().Add(2*time.Minute))
+		if err := cr.reloadIfChanged(); err == nil {
+			t.Fatal("expected validation error")
+		}
+		if cr.Server() != before {
+			t.Fatal("server swapped despite invalid config")
+		}
+	})
+
+	t.Run("explicit reload", func(t *testing.T) {
+		rewriteConfig(t, path, "awsAccountId: \"123456789012\"\nawsRegion: eu-west-1\n", time.Now().Add(3*time.Minute))
+		if err := cr.Reload(); err != nil {
+			t.Fatalf("Reload: %v", err)
+		}
+		if want := "123456789012.dkr.ecr.eu-west-1.amazonaws.com/"; cr.Server().ecrRegistryHostname != want {
+			t.Fatalf("ecrRegistryHostname = %q, want %q", cr.Server().ecrRegistryHostname, want)
+		}
+	})
+}
+
+func TestConfigReloader_SIGHUP(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfig(t, "awsAccountId: \"123456789012\"\nawsRegion: us-east-1\n")
+	cr, err := newConfigReloader(path, true)
+	if err != nil {
+		t.Fatalf("newConfigReloader: %v", err)
+	}
+	// Keeps SIGHUP from terminating the test binary until Watch listens.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Polling never fires, so only SIGHUP reloads.
+		cr.Watch(ctx, time.Hour)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	rewriteConfig(t, path, "awsAccountId: \"123456789012\"\nawsRegion: eu-west-1\n", time.Now().Add(time.Minute))
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("find process: %v", err)
+	}
+	const want = "123456789012.dkr.ecr.eu-west-1.amazonaws.com/"
+	// Signals sent before Watch called signal.Notify are missed, so keep
+	// sending until the server is swapped.
+	for deadline := time.Now().Add(5 * time.Second); cr.Server().ecrRegistryHostname != want; {
+		if time.Now().After(deadline) {
+			t.Fatalf("ecrRegistryHostname = %q after SIGHUP, want %q", cr.Server().ecrRegistryHostname, want)
+		}
+		if err := self.Signal(syscall.SIGHUP); err != nil {
+			t.Fatalf("send SIGHUP: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	prev := &config{AWSAccountID: "123456789012", AWSRegion: "us-east-1", Registries: []registryConfig{{Host: "docker.io"}, {Host: "quay.io"}}}
+	next := &config{AWSAccountID: "123456789012", AWSRegion: "eu-west-1", Registries: []registryConfig{{Host: "docker.io", Prefix: "dockerhub"}, {Host: "ghcr.io"}}}
+
+	got := diffConfig(prev, next)
+	want := []string{
+		`awsRegion: "us-east-1" -> "eu-west-1"`,
+		`registries: +{"host":"docker.io","prefix":"dockerhub"}`,
+		`registries: +"ghcr.io"`,
+		`registries: -"docker.io"`,
+		`registries: -"quay.io"`,
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("diffConfig = %q, want %q", got, want)
+	}
+
+	if got := diffConfig(prev, prev); len(got) != 0 {
+		t.Fatalf("expected no changes, got %q", got)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a registries.yaml into a temp dir and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "registries.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+// clearConfigEnv makes sure the test only sees the config file.
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+	for _, k := range []string{"ECR_CONFIG_FILE", "ECR_AWS_ACCOUNT_ID", "ECR_AWS_REGION", "ECR_REGISTRIES", "ECR_DRY_RUN"} {
+		t.Setenv(k, "")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Run("reads the configmap schema", func(t *testing.T) {
+		clearConfigEnv(t)
+		path := writeConfig(t, `
+awsRegion: us-east-1
+awsAccountId: "123456789012"
+registries:
+  - quay.io
+  - docker.io/
+`)
+		cfg, err := loadConfig(path, true)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cfg.AWSAccountID != "123456789012" || cfg.AWSRegion != "us-east-1" {
+			t.Fatalf("unexpected account/region: %+v", cfg)
+		}
+		if want := []registryConfig{{Host: "quay.io"}, {Host: "docker.io"}}; !slices.Equal(cfg.Registries, want) {
+			t.Fatalf("registries = %v, want %v", cfg.Registries, want)
+		}
+	})
+
+	t.Run("unquoted account id is read as a string", func(t *testing.T) {
+		clearConfigEnv(t)
+		cfg, err := loadConfig(writeConfig(t, "awsRegion: us-east-1\nawsAccountId: 123456789012\n"), true)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cfg.AWSAccountID != "123456789012" {
+			t.Fatalf("awsAccountId = %q", cfg.AWSAccountID)
+		}
+	})
+
+	t.Run("env vars override file values", func(t *testing.T) {
+		clearConfigEnv(t)
+		path := writeConfig(t, `
+awsRegion: us-east-1
+awsAccountId: "123456789012"
+registries: [quay.io]
+`)
+		t.Setenv("ECR_AWS_REGION", "eu-west-1")
+		t.Setenv("ECR_REGISTRIES", "ghcr.io")
+		cfg, err := loadConfig(path, true)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cfg.AWSRegion != "eu-west-1" || cfg.AWSAccountID != "123456789012" {
+			t.Fatalf("unexpected account/region: %+v", cfg)
+		}
+		if want := []registryConfig{{Host: "ghcr.io"}}; !slices.Equal(cfg.Registries, want) {
+			t.Fatalf("registries = %v, want %v", cfg.Registries, want)
+		}
+	})
+
+	t.Run("missing optional file falls back to env", func(t *testing.T) {
+		clearConfigEnv(t)
+		t.Setenv("ECR_AWS_ACCOUNT_ID", "123456789012")
+		t.Setenv("ECR_AWS_REGION", "us-east-1")
+		cfg, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml"), false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := []registryConfig{{Host: "docker.io"}}; !slices.Equal(cfg.Registries, want) {
+			t.Fatalf("registries = %v, want %v", cfg.Registries, want)
+		}
+	})
+
+	t.Run("missing required file is an error", func(t *testing.T) {
+		clearConfigEnv(t)
+		t.Setenv("ECR_AWS_ACCOUNT_ID", "123456789012")
+		t.Setenv("ECR_AWS_REGION", "us-east-1")
+		if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml"), true); err == nil {
+			t.Fatal("expected error for missing config file")
+		}
+	})
+
+	t.Run("registries with ECR prefixes", func(t *testing.T) {
+		clearConfigEnv(t)
+		path := writeConfig(t, `
+awsRegion: us-east-1
+awsAccountId: "123456789012"
+registries:
+  - ghcr.io
+  - host: docker.io
+    prefix: dockerhub
+  - host: registry.k8s.io
+    prefix: /k8s/
+`)
+		cfg, err := loadConfig(path, true)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := []registryConfig{{Host: "ghcr.io"}, {Host: "docker.io", Prefix: "dockerhub"}, {Host: "registry.k8s.io", Prefix: "k8s"}}
+		if !slices.Equal(cfg.Registries, want) {
+			t.Fatalf("registries = %v, want %v", cfg.Registries, want)
+		}
+	})
+
+	t.Run("ECR_REGISTRIES accepts host=prefix", func(t *testing.T) {
+		clearConfigEnv(t)
+		t.Setenv("ECR_AWS_ACCOUNT_ID", "123456789012")
+		t.Setenv("ECR_AWS_REGION", "us-east-1")
+		t.Setenv("ECR_REGISTRIES", "docker.io=dockerhub, ghcr.io")
+		cfg, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml"), false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := []registryConfig{{Host: "docker.io", Prefix: "dockerhub"}, {Host: "ghcr.io"}}
+		if !slices.Equal(cfg.Registries, want) {
+			t.Fatalf("registries = %v, want %v", cfg.Registries, want)
+		}
+	})
+
+	t.Run("ECR_DRY_RUN overrides dryRun", func(t *testing.T) {
+		clearConfigEnv(t)
+		t.Setenv("ECR_DRY_RUN", "true")
+		cfg, err := loadConfig(writeConfig(t, "awsRegion: us-east-1\nawsAccountId: \"123456789012\"\ndryRun: false\n"), true)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !cfg.DryRun {
+			t.Fatal("dryRun = false, want true")
+		}
+
+		t.Setenv("ECR_DRY_RUN", "maybe")
+		if _, err := loadConfig(writeConfig(t, "awsRegion: us-east-1\nawsAccountId: \"123456789012\"\n"), true); err == nil || !strings.Contains(err.Error(), `ECR_DRY_RUN: "maybe" is not a boolean`) {
+			t.Fatalf("err = %v, want ECR_DRY_RUN error", err)
+		}
+	})
+
+	t.Run("newServer uses ECR_CONFIG_FILE", func(t *testing.T) {
+		clearConfigEnv(t)
+		t.Setenv("ECR_CONFIG_FILE", writeConfig(t, "awsRegion: eu-central-1\nawsAccountId: \"424242424242\"\n"))
+		srv, err := newServer()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := "424242424242.dkr.ecr.eu-central-1.amazonaws.com/"; srv.ecrRegistryHostname != want {
+			t.Fatalf("ecrRegistryHostname = %q, want %q", srv.ecrRegistryHostname, want)
+		}
+	})
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr []string
+	}{
+		{
+			name:    "unknown key",
+			content: "awsRegion: us-east-1\nawsAccountId: \"123456789012\"\nregistry: [ghcr.io]\n",
+			wantErr: []string{`unknown field "registry"`},
+		},
+		{
+			name:    "missing required keys",
+			content: "registries: [ghcr.io]\n",
+			wantErr: []string{"awsAccountId: is required", "awsRegion: is required"},
+		},
+		{
+			name:    "invalid values point at their key",
+			content: "awsRegion: US_EAST\nawsAccountId: \"12ab\"\nregistries: [ghcr.io, \"https://quay.io\", ghcr.io]\n",
+			wantErr: []string{
+				`awsAccountId: "12ab"`,
+				`awsRegion: "US_EAST"`,
+				`registries[1]: "https://quay.io" is not a valid registry hostname`,
+				`registries[2]: "ghcr.io" is listed more than once`,
+			},
+		},
+		{
+			name:    "invalid prefix",
+			content: "awsRegion: us-east-1\nawsAccountId: \"123456789012\"\nregistries:\n  - host: docker.io\n    prefix: Docker_Hub\n",
+			wantErr: []string{`registries[0].prefix: "Docker_Hub" is not a valid ECR repository prefix`},
+		},
+		{
+			name:    "invalid rule",
+			content: "awsRegion: us-east-1\nawsAccountId: \"123456789012\"\nrules:\n  - match: docker.io/*\n    action: drop\n",
+			wantErr: []string{`rules[0].action: "drop" must be one of rewrite, skip or deny`},
+		},
+		{
+			name:    "invalid dry-run namespace",
+			content: "awsRegion: us-east-1\nawsAccountId: \"123456789012\"\ndryRunNamespaces: [\"team-[\"]\n",
+			wantErr: []string{`dryRunNamespaces[0]: "team-[" is not a valid namespace pattern`},
+		},
+		{
+			name:    "invalid validation scope",
+			content: "awsRegion: us-east-1\nawsAccountId: \"123456789012\"\nvalidationScope: everything\n",
+			wantErr: []string{`validationScope: "everything" must be one of configured or all`},
+		},
+		{
+			name:    "invalid digest pinning",
+			content: "awsRegion: us-east-1\nawsAccountId: \"123456789012\"\npinDigests:\n  enabled: true\n  source: mirror\n  cacheSize: -1\n",
+			wantErr: []string{
+				`pinDigests.source: "mirror" must be one of upstream or cache`,
+				`pinDigests.cacheSize: -1 must not be negative`,
+			},
+		},
+		{
+			name:    "invalid digest pinning timeout",
+			content: "awsRegion: us-east-1\nawsAccountId: \"123456789012\"\npinDigests:\n  timeout: soon\n",
+			wantErr: []string{`invalid duration "soon"`},
+		},
+		{
+			name:    "invalid targets",
+			content: "awsRegion: us-east-1\nawsAccountId: \"123456789012\"\ntargets:\n  - name: default\n    awsAccountId: \"222222222222\"\n    awsRegion: eu-west-1\n  - name: team-a\n    awsAccountId: \"abc\"\n    awsRegion: eu-west-1\n  - name: team-a\n    awsAccountId: \"333333333333\"\n    awsRegion: eu-west-1\nnamespaceTargets:\n  payments: team-b\n",
+			wantErr: []string{
+				`targets[0].name: "default" is reserved for awsAccountId and awsRegion`,
+				`targets[1].awsAccountId: "abc" must be a 12-digit AWS account ID`,
+				`targets[2].name: "team-a" is listed more than once`,
+				`namespaceTargets[payments]: target "team-b" is not defined in targets`,
+			},
+		},
+		{
+			name:    "invalid ECR endpoint",
+			content: "awsRegion: us-east-1\nawsAccountId: \"123456789012\"\necrEndpoint: ipv6\n",
+			wantErr: []string{`ecrEndpoint: "ipv6" must be one of standard, fips or dualstack`},
+		},
+		{
+			name:    "endpoints the partition does not offer",
+			content: "awsRegion: cn-north-1\nawsAccountId: \"123456789012\"\necrEndpoint: fips\ntargets:\n  - name: iso\n    awsAccountId: \"222222222222\"\n    awsRegion: us-iso-east-1\n  - name: vpce\n    awsAccountId: \"333333333333\"\n    awsRegion: us-east-1\n    ecrHostname: \"https://vpce-1.dkr.ecr.us-east-1.vpce.amazonaws.com\"\n",
+			wantErr: []string{
+				`awsRegion: region "cn-north-1" has no FIPS endpoints`,
+				`targets[0].awsRegion: region "us-iso-east-1" is in partition aws-iso, set ecrHostname to its ECR registry`,
+				`targets[1].ecrHostname: "https://vpce-1.dkr.ecr.us-east-1.vpce.amazonaws.com" is not a valid registry hostname`,
+			},
+		},
+		{
+			name:    "short account ID",
+			content: "awsRegion: us-east-1\nawsAccountId: \"12345\"\n",
+			wantErr: []string{`awsAccountId: "12345" must be a 12-digit AWS account ID`},
+		},
+		{
+			name:    "FIPS outside the US",
+			content: "awsRegion: eu-west-1\nawsAccountId: \"123456789012\"\necrEndpoint: fips\n",
+			wantErr: []string{`awsRegion: region "eu-west-1" has no FIPS endpoints`},
+		},
+		{
+			name:    "invalid registry aliases",
+			content: "awsRegion: us-east-1\nawsAccountId: \"123456789012\"\nregistries: [docker.io, k8s.gcr.io]\nregistryAliases:\n  quay.io: quay.io\n  mirror.gcr.io: index.docker.io\n",
+			wantErr: []string{
+				`registryAliases[quay.io]: an alias cannot name itself, map it to "" to remove it`,
+				`registryAliases[mirror.gcr.io]: "index.docker.io" is itself an alias of "docker.io", map it to "docker.io" directly`,
+				`registries[1]: "k8s.gcr.io" is an alias of "registry.k8s.io" and never matches`,
+			},
+		},
+		{
+			name:    "unknown registry key",
+			content: "awsRegion: us-east-1\nawsAccountId: \"123456789012\"\nregistries:\n  - host: docker.io\n    prefx: dockerhub\n",
+			wantErr: []string{`unknown field "prefx"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			_, err := loadConfig(writeConfig(t, tt.content), true)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
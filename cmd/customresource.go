@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// customResourceConfig is an entry of the customResources list in
+// registries.yaml. It declares where a kind keeps its image references:
+//
+//	customResources:
+//	  - group: argoproj.io
+//	    kind: Rollout
+//	    version: v1alpha1            # optional, any version when empty
+//	    paths:
+//	      - /spec/template/spec/containers/*/image
+//	      - /spec/template/spec/initContainers/*/image
+//
+// Paths are JSON pointers (RFC 6901) in which a "*" segment matches every
+// element of an array or every value of an object. Fields that are missing
+// or not strings are ignored.
+type customResourceConfig struct {
+	Group   string   `json:"group,omitempty"`
+	Version string   `json:"version,omitempty"`
+	Kind    string   `json:"kind"`
+	Paths   []string `json:"paths"`
+}
+
+// customResourceRule is a parsed customResourceConfig.
+type customResourceRule struct {
+	group, version, kind string
+	paths                [][]string // unescaped pointer segments
+}
+
+// compileCustomResources parses the configured custom resources, reporting
+// every invalid entry prefixed with its key.
+func compileCustomResources(resources []customResourceConfig) ([]customResourceRule, error) {
+	var errs []error
+	compiled := make([]customResourceRule, 0, len(resources))
+	seen := map[string]bool{}
+	for i, r := range resources {
+		key := fmt.Sprintf("customResources[%d]", i)
+		if r.Kind == "" {
+			errs = append(errs, fmt.Errorf("%s.kind: is required", key))
+		}
+		gvk := r.Group + "/" + r.Version + "/" + r.Kind
+		if seen[gvk] {
+			errs = append(errs, fmt.Errorf("%s: kind %q in group %q is listed more than once", key, r.Kind, r.Group))
+		}
+		seen[gvk] = true
+		if len(r.Paths) == 0 {
+			errs = append(errs, fmt.Errorf("%s.paths: at least one path is required", key))
+		}
+
+		rule := customResourceRule{group: r.Group, version: r.Version, kind: r.Kind}
+		for j, p := range r.Paths {
+			segments, err := parsePointer(p)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s.paths[%d]: %w", key, j, err))
+				continue
+			}
+			rule.paths = append(rule.paths, segments)
+		}
+		compiled = append(compiled, rule)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return compiled, nil
+}
+
+// parsePointer splits a JSON pointer into unescaped segments.
+func parsePointer(p string) ([]string, error) {
+	if !strings.HasPrefix(p, "/") || p == "/" {
+		return nil, fmt.Errorf("%q must be a JSON pointer starting with '/'", p)
+	}
+	segments := strings.Split(p[1:], "/")
+	for i, s := range segments {
+		if s == "" {
+			return nil, fmt.Errorf("%q has an empty segment", p)
+		}
+		segments[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(s)
+	}
+	return segments, nil
+}
+
+// escapePointerSegment escapes a key for use in a JSON pointer.
+func escapePointerSegment(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+// findCustomResource returns the rule declared for gvk, if any.
+func findCustomResource(rules []customResourceRule, gvk metav1.GroupVersionKind) (customResourceRule, bool) {
+	i := slices.IndexFunc(rules, func(r customResourceRule) bool {
+		return r.group == gvk.Group && r.kind == gvk.Kind && (r.version == "" || r.version == gvk.Version)
+	})
+	if i < 0 {
+		return customResourceRule{}, false
+	}
+	return rules[i], true
+}
+
+// imageField is a string field holding an image reference.
+type imageField struct {
+	path      string // concrete JSON pointer
+	image     string
+	container string // container name, empty for custom resource fields
+}
+
+// label names the field in messages shown to users.
+func (f imageField) label() string {
+	if f.container != "" {
+		return fmt.Sprintf("container %q", f.container)
+	}
+	return fmt.Sprintf("field %q", f.path)
+}
+
+// findImageFields decodes raw and returns every string field matched by the
+// rule's paths, in path order and array order.
+func findImageFields(rule customResourceRule, raw []byte) ([]imageField, error) {
+	var doc any
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("unable unmarshal %s json object %v", rule.kind, err)
+	}
+	var fields []imageField
+	seen := map[string]bool{}
+	for _, segments := range rule.paths {
+		walkPointer(doc, segments, "", func(path string, v any) {
+			if image, ok := v.(string); ok && !seen[path] {
+				seen[path] = true
+				fields = append(fields, imageField{path: path, image: image})
+			}
+		})
+	}
+	return fields, nil
+}
+
+// walkPointer calls fn with every value reachable from node through
+// segments, expanding "*" over arrays and objects.
+func walkPointer(node any, segments []string, path string, fn func(path string, v any)) {
+	if len(segments) == 0 {
+		fn(path, node)
+		return
+	}
+	seg, rest := segments[0], segments[1:]
+	switch n := node.(type) {
+	case map[string]any:
+		if seg == "*" {
+			keys := make([]string, 0, len(n))
+			for k := range n {
+				keys = append(keys, k)
+			}
+			slices.Sort(keys)
+			for _, k := range keys {
+				walkPointer(n[k], rest, path+"/"+escapePointerSegment(k), fn)
+			}
+			return
+		}
+		if v, ok := n[seg]; ok {
+			walkPointer(v, rest, path+"/"+escapePointerSegment(seg), fn)
+		}
+	case []any:
+		if seg == "*" {
+			for i, v := range n {
+				walkPointer(v, rest, path+"/"+strconv.Itoa(i), fn)
+			}
+			return
+		}
+		if i, err := strconv.Atoi(seg); err == nil && i >= 0 && i < len(n) {
+			walkPointer(n[i], rest, path+"/"+seg, fn)
+		}
+	}
+}
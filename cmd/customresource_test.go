@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCompileCustomResources_Errors(t *testing.T) {
+	_, err := compileCustomResources([]customResourceConfig{
+		{Group: "argoproj.io", Kind: "Rollout", Paths: []string{"/spec/template/spec/containers/*/image"}},
+		{Group: "argoproj.io", Kind: "Rollout", Paths: []string{"/spec/image"}},
+		{Group: "serving.knative.dev", Paths: []string{"spec/image"}},
+		{Group: "example.com", Kind: "Thing", Paths: []string{"/spec//image"}},
+		{Group: "example.com", Kind: "Other"},
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, want := range []string{
+		`customResources[1]: kind "Rollout" in group "argoproj.io" is listed more than once`,
+		"customResources[2].kind: is required",
+		`customResources[2].paths[0]: "spec/image" must be a JSON pointer`,
+		`customResources[3].paths[0]: "/spec//image" has an empty segment`,
+		"customResources[4].paths: at least one path is required",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestFindImageFields(t *testing.T) {
+	rules, err := compileCustomResources([]customResourceConfig{{
+		Group: "serving.kserve.io",
+		Kind:  "InferenceService",
+		Paths: []string{
+			"/spec/*/containers/*/image",
+			"/spec/predictor/model/image",
+			"/metadata/annotations/example.com~1image",
+			"/spec/predictor/containers/0/image", // duplicate of a wildcard match
+		},
+	}})
+	if err != nil {
+		t.Fatalf("compileCustomResources: %v", err)
+	}
+	raw := []byte(`{
+		"metadata": {"annotations": {"example.com/image": "busybox"}},
+		"spec": {
+			"predictor": {
+				"containers": [{"image": "nginx"}, {"name": "no-image"}, {"image": 42}],
+				"model": {"image": "owner/model:1"}
+			},
+			"transformer": {"containers": [{"image": "ghcr.io/org/transformer"}]}
+		}
+	}`)
+
+	fields, err := findImageFields(rules[0], raw)
+	if err != nil {
+		t.Fatalf("findImageFields: %v", err)
+	}
+	want := []imageField{
+		{path: "/spec/predictor/containers/0/image", image: "nginx"},
+		{path: "/spec/transformer/containers/0/image", image: "ghcr.io/org/transformer"},
+		{path: "/spec/predictor/model/image", image: "owner/model:1"},
+		{path: "/metadata/annotations/example.com~1image", image: "busybox"},
+	}
+	if len(fields) != len(want) {
+		t.Fatalf("fields = %+v, want %+v", fields, want)
+	}
+	for i := range want {
+		if fields[i] != want[i] {
+			t.Errorf("fields[%d] = %+v, want %+v", i, fields[i], want[i])
+		}
+	}
+}
+
+func TestMutate_CustomResource(t *testing.T) {
+	srv, err := newServerFromConfig(&config{
+		AWSAccountID: "123456789012",
+		AWSRegion:    "us-west-2",
+		Registries:   []registryConfig{{Host: "docker.io"}},
+		Rules:        []ruleConfig{{Match: "docker.io/licensed/*", Action: actionDeny}},
+		CustomResources: []customResourceConfig{{
+			Group:   "argoproj.io",
+			Version: "v1alpha1",
+			Kind:    "Rollout",
+			Paths:   []string{"/spec/template/spec/containers/*/image"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("newServerFromConfig: %v", err)
+	}
+	rollout := map[string]any{
+		"metadata": map[string]any{"name": "web"},
+		"spec": map[string]any{"template": map[string]any{"spec": map[string]any{
+			"containers": []any{
+				map[string]any{"name": "app", "image": "nginx:1.27"},
+				map[string]any{"name": "side", "image": "quay.io/org/side"},
+			},
+		}}},
+	}
+	gvk := metav1.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"}
+
+	t.Run("configured paths are patched", func(t *testing.T) {
+		out := reviewObject(t, srv, gvk, rollout)
+		got := imagePatches(t, out)
+		want := "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx:1.27"
+		if len(got) != 1 || got["/spec/template/spec/containers/0/image"] != want {
+			t.Fatalf("patches = %v", got)
+		}
+	})
+
+	t.Run("other versions are ignored", func(t *testing.T) {
+		out := reviewObject(t, srv, metav1.GroupVersionKind{Group: "argoproj.io", Version: "v1", Kind: "Rollout"}, rollout)
+		if got := imagePatches(t, out); len(got) != 0 {
+			t.Fatalf("expected no patches, got %v", got)
+		}
+	})
+
+	t.Run("denials name the field", func(t *testing.T) {
+		rollout["spec"].(map[string]any)["template"].(map[string]any)["spec"].(map[string]any)["containers"] = []any{
+			map[string]any{"name": "app", "image": "licensed/tool"},
+		}
+		out := reviewObject(t, srv, gvk, rollout)
+		if out.Response.Allowed {
+			t.Fatal("expected denial")
+		}
+		if !strings.Contains(out.Response.Result.Message, `field "/spec/template/spec/containers/0/image"`) {
+			t.Fatalf("message does not name the field: %q", out.Response.Result.Message)
+		}
+	})
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"cmp"
+	"container/list"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Digest pinning sources.
+const (
+	pinSourceUpstream = "upstream"
+	pinSourceCache    = "cache"
+)
+
+// pinDigestsConfig is the pinDigests section of registries.yaml:
+//
+//	pinDigests:
+//	  enabled: true
+//	  source: upstream    # resolve tags at the upstream registry, or "cache" at ECR
+//	  timeout: 2s         # budget for all lookups of one admission request
+//	  cacheSize: 1000     # resolved tags kept in memory
+//	  cacheTTL: 10m       # how long a resolved tag is reused
+//	  credentialsFile: /etc/ecr-pull-through/auth/config.json
+//
+// When enabled, /mutate resolves the tag of every rewritten image through the
+// registry v2 API and writes <ecr>/<prefix>/<path>@<digest>. Images that
+// already carry a digest are not looked up. credentialsFile is an optional
+// Docker config.json whose "auths" are used when a registry asks for
+// credentials; it is re-read on every lookup so rotated tokens are picked up.
+type pinDigestsConfig struct {
+	Enabled         bool     `json:"enabled"`
+	Source          string   `json:"source,omitempty"`
+	Timeout         duration `json:"timeout,omitzero"`
+	CacheSize       int      `json:"cacheSize,omitempty"`
+	CacheTTL        duration `json:"cacheTTL,omitzero"`
+	CredentialsFile string   `json:"credentialsFile,omitempty"`
+}
+
+// Defaults of pinDigestsConfig.
+const (
+	defaultPinTimeout   = 2 * time.Second
+	defaultPinCacheSize = 1000
+	defaultPinCacheTTL  = 10 * time.Minute
+)
+
+// duration is a time.Duration written as a Go duration string, e.g. "2s".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("%s is not a duration string", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// validate reports every invalid pinDigests field, prefixed with its key.
+func (c pinDigestsConfig) validate() error {
+	var errs []error
+	switch c.Source {
+	case "", pinSourceUpstream, pinSourceCache:
+	default:
+		errs = append(errs, fmt.Errorf("pinDigests.source: %q must be one of upstream or cache", c.Source))
+	}
+	if c.Timeout.Duration < 0 {
+		errs = append(errs, fmt.Errorf("pinDigests.timeout: %s must not be negative", c.Timeout))
+	}
+	if c.CacheSize < 0 {
+		errs = append(errs, fmt.Errorf("pinDigests.cacheSize: %d must not be negative", c.CacheSize))
+	}
+	if c.CacheTTL.Duration < 0 {
+		errs = append(errs, fmt.Errorf("pinDigests.cacheTTL: %s must not be negative", c.CacheTTL))
+	}
+	return errors.Join(errs...)
+}
+
+// manifestMediaTypes are the manifest and index types a lookup accepts, so
+// that multi-arch tags resolve to their index digest.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// digestResolver resolves image tags to manifest digests through the
+// registry v2 API, remembering recent answers.
+type digestResolver struct {
+	source          string
+	timeout         time.Duration
+	credentialsFile string
+	client          *http.Client
+	cache           *digestCache
+	// baseURL returns the scheme and host serving the v2 API of a registry.
+	baseURL func(registry string) string
+}
+
+func newDigestResolver(cfg pinDigestsConfig) *digestResolver {
+	size := cfg.CacheSize
+	if size == 0 {
+		size = defaultPinCacheSize
+	}
+	ttl := cfg.CacheTTL.Duration
+	if ttl == 0 {
+		ttl = defaultPinCacheTTL
+	}
+	timeout := cfg.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultPinTimeout
+	}
+	source := cfg.Source
+	if source == "" {
+		source = pinSourceUpstream
+	}
+	return &digestResolver{
+		source:          source,
+		timeout:         timeout,
+		credentialsFile: cfg.CredentialsFile,
+		client:          &http.Client{},
+		cache:           newDigestCache(size, ttl),
+		baseURL:         registryBaseURL,
+	}
+}
+
+// registryBaseURL returns the v2 API endpoint of a registry. Docker Hub
+// serves its API from a different host than its reference domain.
+func registryBaseURL(registry string) string {
+	if registry+"/" == dockerHubRegistry {
+		registry = "registry-1.docker.io"
+	}
+	return "https://" + registry
+}
+
+// pinDigest returns rewritten, the pull-through cache path of image, pinned
+// to the digest its tag currently points to. Images without a tag resolve
+// "latest". Images with a digest are returned unchanged, as is rewritten on
+// error.
+func (s *server) pinDigest(ctx context.Context, image, rewritten string) (string, error) {
+	original, err := s.parseImage(image)
+	if err != nil || original.Digest != "" {
+		return rewritten, err
+	}
+	cached, err := parseReference(rewritten)
+	if err != nil {
+		return rewritten, err
+	}
+	at := original
+	if s.digests.source == pinSourceCache {
+		at = cached
+	}
+	digest, err := s.digests.resolve(ctx, at.Domain, at.Path, cmp.Or(original.Tag, "latest"))
+	if err != nil {
+		return rewritten, err
+	}
+	return cached.Name() + "@" + digest, nil
+}
+
+// isPinnedRewrite reports whether image is rewritten pinned to a digest.
+// It lets the original-images annotation survive re-admission of pinned pods.
+func isPinnedRewrite(image, rewritten string) bool {
+	ref, err := parseReference(image)
+	if err != nil || ref.Digest == "" || ref.Tag != "" {
+		return false
+	}
+	r, err := parseReference(rewritten)
+	return err == nil && r.Digest == "" && r.Name() == ref.Name()
+}
+
+// resolve returns the digest of repository:tag at registry, from the cache
+// when it holds a recent answer.
+func (r *digestResolver) resolve(ctx context.Context, registry, repository, tag string) (string, error) {
+	key := registry + "/" + repository + ":" + tag
+	if digest, ok := r.cache.get(key); ok {
+		observeDigestLookup("cached")
+		return digest, nil
+	}
+	digest, err := r.lookup(ctx, registry, repository, tag)
+	if err != nil {
+		observeDigestLookup("error")
+		return "", fmt.Errorf("resolving %s: %w", key, err)
+	}
+	observeDigestLookup("resolved")
+	r.cache.add(key, digest)
+	return digest, nil
+}
+
+// lookup sends a HEAD request for the manifest, answering one
+// authentication challenge.
+func (r *digestResolver) lookup(ctx context.Context, registry, repository, tag string) (string, error) {
+	manifestURL := fmt.Sprintf("%s/v2/%s/manifests/%s", r.baseURL(registry), repository, tag)
+	resp, err := r.head(ctx, manifestURL, "")
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		authorization, err := r.authorize(ctx, registry, repository, resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return "", err
+		}
+		if resp, err = r.head(ctx, manifestURL, authorization); err != nil {
+			return "", err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry returned %s", resp.Status)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if !validDigest(digest) {
+		return "", fmt.Errorf("registry returned invalid Docker-Content-Digest %q", digest)
+	}
+	return digest, nil
+}
+
+func (r *digestResolver) head(ctx context.Context, manifestURL, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// authorize answers a WWW-Authenticate challenge with the value of an
+// Authorization header. Bearer challenges are exchanged for a pull token,
+// anonymously unless credentials are configured for the registry; Basic
+// challenges require credentials.
+func (r *digestResolver) authorize(ctx context.Context, registry, repository, challenge string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	username, password, hasCredentials, err := r.credentials(registry)
+	if err != nil {
+		return "", err
+	}
+	switch scheme {
+	case "basic":
+		if !hasCredentials {
+			return "", fmt.Errorf("registry requires credentials for %s", registry)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+	case "bearer":
+		realm, err := url.Parse(params["realm"])
+		if err != nil || realm.Scheme == "" {
+			return "", fmt.Errorf("invalid bearer realm %q", params["realm"])
+		}
+		q := realm.Query()
+		if service := params["service"]; service != "" {
+			q.Set("service", service)
+		}
+		q.Set("scope", "repository:"+repository+":pull")
+		realm.RawQuery = q.Encode()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if hasCredentials {
+			req.SetBasicAuth(username, password)
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+		}
+		var token struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+			return "", fmt.Errorf("decoding token: %w", err)
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		if token.Token == "" {
+			return "", errors.New("token endpoint returned no token")
+		}
+		return "Bearer " + token.Token, nil
+	}
+	return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+}
+
+// parseChallenge splits a WWW-Authenticate header such as
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`
+// into its lowercased scheme and parameters.
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := map[string]string{}
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.HasPrefix(value, `"`) {
+			end := strings.IndexByte(value[1:], '"')
+			if end < 0 {
+				break
+			}
+			params[key], rest = value[1:end+1], value[end+2:]
+		} else {
+			params[key], rest, _ = strings.Cut(value, ",")
+		}
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+	}
+	return strings.ToLower(scheme), params
+}
+
+// credentials returns the credentials for registry from the Docker
+// config.json at credentialsFile.
+func (r *digestResolver) credentials(registry string) (username, password string, ok bool, err error) {
+	if r.credentialsFile == "" {
+		return "", "", false, nil
+	}
+	data, err := os.ReadFile(r.credentialsFile)
+	if err != nil {
+		return "", "", false, fmt.Errorf("reading credentials: %w", err)
+	}
+	var cfg struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return "", "", false, fmt.Errorf("parsing credentials %s: %w", r.credentialsFile, err)
+	}
+	for _, key := range []string{registry, "https://" + registry, registryBaseURL(registry)} {
+		a, found := cfg.Auths[key]
+		if !found {
+			continue
+		}
+		if a.Auth == "" {
+			return a.Username, a.Password, true, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return "", "", false, fmt.Errorf("credentials for %s: invalid auth: %w", registry, err)
+		}
+		username, password, _ = strings.Cut(string(decoded), ":")
+		return username, password, true, nil
+	}
+	return "", "", false, nil
+}
+
+// digestCache is a size-bounded LRU cache of resolved digests whose entries
+// expire after ttl, so moved tags are picked up again.
+type digestCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List // most recently used first
+	now     func() time.Time
+}
+
+type digestCacheEntry struct {
+	key     string
+	digest  string
+	expires time.Time
+}
+
+func newDigestCache(size int, ttl time.Duration) *digestCache {
+	return &digestCache{size: size, ttl: ttl, entries: map[string]*list.Element{}, order: list.New(), now: time.Now}
+}
+
+func (c *digestCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := el.Value.(*digestCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return "", false
+	}
+	c.order.MoveToFront(el)
+	return entry.digest, true
+}
+
+func (c *digestCache) add(key, digest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*digestCacheEntry)
+		entry.digest, entry.expires = digest, expires
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&digestCacheEntry{key: key, digest: digest, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*digestCacheEntry).key)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const otherDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// testRegistry is a registry v2 stand-in serving manifest digests by
+// "<repository>:<tag>". With token set it asks for a bearer token from its
+// /token endpoint; with basic set it asks for those basic credentials.
+type testRegistry struct {
+	*httptest.Server
+	digests  map[string]string
+	token    string
+	basic    string // "user:password"
+	delay    time.Duration
+	requests atomic.Int32
+}
+
+func newTestRegistry(t *testing.T, digests map[string]string) *testRegistry {
+	t.Helper()
+	reg := &testRegistry{digests: digests}
+	reg.Server = httptest.NewTLSServer(http.HandlerFunc(reg.serve))
+	t.Cleanup(reg.Close)
+	return reg
+}
+
+func (reg *testRegistry) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		if r.URL.Query().Get("scope") == "" || r.URL.Query().Get("service") != "test-registry" {
+			http.Error(w, "bad token request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"token": %q}`, reg.token)
+		return
+	}
+
+	reg.requests.Add(1)
+	time.Sleep(reg.delay)
+	repository, tag, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/")
+	if r.Method != http.MethodHead || !ok || !strings.Contains(r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json") {
+		http.Error(w, "bad manifest request", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case reg.token != "" && r.Header.Get("Authorization") != "Bearer "+reg.token:
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test-registry",scope="repository:%s:pull"`, reg.URL, repository))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	case reg.basic != "" && r.Header.Get("Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(reg.basic)):
+		w.Header().Set("WWW-Authenticate", `Basic realm="test-registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	digest, ok := reg.digests[repository+":"+tag]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Docker-Content-Digest", digest)
+}
+
+// host returns the registry's host:port, usable as an image domain.
+func (reg *testRegistry) host() string {
+	return strings.TrimPrefix(reg.URL, "https://")
+}
+
+// useRegistry sends the lookups of resolver to reg, whatever the registry.
+func useRegistry(resolver *digestResolver, reg *testRegistry) {
+	resolver.client = reg.Client()
+	resolver.baseURL = func(string) string { return reg.URL }
+}
+
+func TestDigestResolver(t *testing.T) {
+	reg := newTestRegistry(t, map[string]string{"library/nginx:1.27": testDigest})
+	reg.token = "pull-token"
+	resolver := newDigestResolver(pinDigestsConfig{Enabled: true})
+	useRegistry(resolver, reg)
+
+	for range 2 {
+		digest, err := resolver.resolve(context.Background(), "docker.io", "library/nginx", "1.27")
+		if err != nil {
+			t.Fatalf("resolve: %v", err)
+		}
+		if digest != testDigest {
+			t.Fatalf("digest = %s, want %s", digest, testDigest)
+		}
+	}
+	// One challenged and one authorized request; the second resolve is cached.
+	if n := reg.requests.Load(); n != 2 {
+		t.Errorf("registry got %d manifest requests, want 2", n)
+	}
+
+	if _, err := resolver.resolve(context.Background(), "docker.io", "library/nginx", "missing"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("resolve of a missing tag: err = %v, want 404", err)
+	}
+}
+
+func TestDigestResolver_Credentials(t *testing.T) {
+	reg := newTestRegistry(t, map[string]string{"team/app:v1": testDigest})
+	reg.basic = "AWS:secret"
+	resolver := newDigestResolver(pinDigestsConfig{Enabled: true})
+	useRegistry(resolver, reg)
+
+	if _, err := resolver.resolve(context.Background(), reg.host(), "team/app", "v1"); err == nil || !strings.Contains(err.Error(), "requires credentials") {
+		t.Fatalf("resolve without credentials: err = %v", err)
+	}
+
+	resolver.credentialsFile = filepath.Join(t.TempDir(), "config.json")
+	auth := base64.StdEncoding.EncodeToString([]byte(reg.basic))
+	if err := os.WriteFile(resolver.credentialsFile, fmt.Appendf(nil, `{"auths": {%q: {"auth": %q}}}`, reg.host(), auth), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := resolver.resolve(context.Background(), reg.host(), "team/app", "v1")
+	if err != nil || digest != testDigest {
+		t.Fatalf("resolve with credentials = %s, %v", digest, err)
+	}
+}
+
+func TestDigestCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := newDigestCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.add("a", "1")
+	c.add("b", "2")
+	c.get("a") // b is now the least recently used
+	c.add("c", "3")
+	if _, ok := c.get("b"); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	for key, want := range map[string]string{"a": "1", "c": "3"} {
+		if got, ok := c.get(key); !ok || got != want {
+			t.Errorf("get(%q) = %q, %t, want %q", key, got, ok, want)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.get("a"); ok {
+		t.Error("expired entry was returned")
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io", scope="repository:library/nginx:pull,push"`)
+	if scheme != "bearer" || params["realm"] != "https://auth.docker.io/token" || params["service"] != "registry.docker.io" || params["scope"] != "repository:library/nginx:pull,push" {
+		t.Errorf("parseChallenge = %q, %v", scheme, params)
+	}
+	if scheme, params := parseChallenge(`Basic realm=ecr`); scheme != "basic" || params["realm"] != "ecr" {
+		t.Errorf("parseChallenge = %q, %v", scheme, params)
+	}
+}
+
+func TestMutate_PinDigests(t *testing.T) {
+	const ecr = "123456789012.dkr.ecr.us-west-2.amazonaws.com/"
+	newPinningServer := func(t *testing.T, reg *testRegistry, pin string) *server {
+		t.Helper()
+		clearConfigEnv(t)
+		t.Setenv("ECR_CONFIG_FILE", writeConfig(t, "awsAccountId: \"123456789012\"\nawsRegion: us-west-2\nregistries: [docker.io, ghcr.io]\npinDigests:\n"+pin))
+		srv, err := newServer()
+		if err != nil {
+			t.Fatalf("newServer: %v", err)
+		}
+		useRegistry(srv.digests, reg)
+		return srv
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "web", Image: "nginx:1.27"},
+			{Name: "app", Image: "ghcr.io/owner/app"},
+			{Name: "pinned", Image: "ghcr.io/owner/app:v1@" + otherDigest},
+		}},
+	}
+
+	t.Run("upstream", func(t *testing.T) {
+		reg := newTestRegistry(t, map[string]string{"library/nginx:1.27": testDigest, "owner/app:latest": otherDigest})
+		reg.token = "pull-token"
+		srv := newPinningServer(t, reg, "  enabled: true\n")
+		checkMutatePatch(t, srv, pod, map[string]string{
+			"/spec/containers/0/image": ecr + "docker.io/library/nginx@" + testDigest,
+			"/spec/containers/1/image": ecr + "ghcr.io/owner/app@" + otherDigest,
+			"/spec/containers/2/image": ecr + "ghcr.io/owner/app:v1@" + otherDigest,
+		})
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		reg := newTestRegistry(t, map[string]string{"docker.io/library/nginx:1.27": testDigest, "ghcr.io/owner/app:latest": otherDigest})
+		srv := newPinningServer(t, reg, "  enabled: true\n  source: cache\n")
+		checkMutatePatch(t, srv, pod, map[string]string{
+			"/spec/containers/0/image": ecr + "docker.io/library/nginx@" + testDigest,
+			"/spec/containers/1/image": ecr + "ghcr.io/owner/app@" + otherDigest,
+			"/spec/containers/2/image": ecr + "ghcr.io/owner/app:v1@" + otherDigest,
+		})
+	})
+
+	t.Run("lookup failure keeps the tag", func(t *testing.T) {
+		reg := newTestRegistry(t, map[string]string{"library/nginx:1.27": testDigest})
+		srv := newPinningServer(t, reg, "  enabled: true\n")
+		review := reviewPod(t, srv, pod)
+		if got := imagePatches(t, review)["/spec/containers/1/image"]; got != ecr+"ghcr.io/owner/app" {
+			t.Errorf("patch = %q, want the unpinned rewrite", got)
+		}
+		if w := strings.Join(review.Response.Warnings, "\n"); !strings.Contains(w, `container "app": image "ghcr.io/owner/app" was not pinned to a digest`) {
+			t.Errorf("warnings = %q", w)
+		}
+	})
+
+	t.Run("timeout budget", func(t *testing.T) {
+		reg := newTestRegistry(t, map[string]string{"library/nginx:1.27": testDigest, "owner/app:latest": otherDigest})
+		reg.delay = 200 * time.Millisecond
+		srv := newPinningServer(t, reg, "  enabled: true\n  timeout: 50ms\n")
+		start := time.Now()
+		review := reviewPod(t, srv, pod)
+		if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+			t.Errorf("mutate took %s, want at most the 50ms budget", elapsed)
+		}
+		patches := imagePatches(t, review)
+		if patches["/spec/containers/0/image"] != ecr+"docker.io/library/nginx:1.27" || patches["/spec/containers/1/image"] != ecr+"ghcr.io/owner/app" {
+			t.Errorf("patches = %v, want unpinned rewrites", patches)
+		}
+		if len(review.Response.Warnings) != 2 {
+			t.Errorf("warnings = %q, want one per unpinned image", review.Response.Warnings)
+		}
+	})
+
+	t.Run("re-admission keeps the original image", func(t *testing.T) {
+		reg := newTestRegistry(t, map[string]string{"library/nginx:1.27": testDigest})
+		srv := newPinningServer(t, reg, "  enabled: true\n")
+		pinned := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{originalImagesAnnotation: `{"web":"nginx:1.27"}`}},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: ecr + "docker.io/library/nginx@" + testDigest}}},
+		}
+		if p := decodePatch(t, reviewPod(t, srv, pinned)); len(p) != 0 {
+			t.Errorf("patch = %+v, want none", p)
+		}
+	})
+}
+
+func TestIsPinnedRewrite(t *testing.T) {
+	const rewritten = "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx:1.27"
+	for image, want := range map[string]bool{
+		"123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx@" + testDigest:      true,
+		"123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx:1.27":               false,
+		"123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx:1.28@" + testDigest: false,
+		"123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/redis@" + testDigest:      false,
+	} {
+		if got := isPinnedRewrite(image, rewritten); got != want {
+			t.Errorf("isPinnedRewrite(%q) = %t, want %t", image, got, want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMutate_DryRun(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "nginx:1.27"}},
+		},
+	}
+
+	t.Run("global dry run reports without patching", func(t *testing.T) {
+		srv := setupServer(t, "123456789012", "us-west-2", "docker.io")
+		srv.dryRun = true
+		out := reviewPod(t, srv, pod)
+		if !out.Response.Allowed {
+			t.Fatalf("expected pod to be allowed, got %v", out.Response.Result)
+		}
+		if len(out.Response.Patch) != 0 && string(out.Response.Patch) != "[]" {
+			t.Fatalf("expected empty patch, got %s", out.Response.Patch)
+		}
+		wantWarning := `dry run: container "app" image "nginx:1.27" would be rewritten to "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx:1.27"`
+		if !slices.Equal(out.Response.Warnings, []string{wantWarning}) {
+			t.Fatalf("warnings = %q, want %q", out.Response.Warnings, wantWarning)
+		}
+		var rewrites []imageRewrite
+		if err := json.Unmarshal([]byte(out.Response.AuditAnnotations["dry-run-rewrites"]), &rewrites); err != nil {
+			t.Fatalf("unmarshal audit annotation: %v", err)
+		}
+		want := []imageRewrite{{
+			Path:      "/spec/containers/0/image",
+			Container: "app",
+			Original:  "nginx:1.27",
+			Rewritten: "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx:1.27",
+		}}
+		if !slices.Equal(rewrites, want) {
+			t.Fatalf("dry-run-rewrites = %+v, want %+v", rewrites, want)
+		}
+	})
+
+	t.Run("namespace patterns select dry run", func(t *testing.T) {
+		srv := setupServer(t, "123456789012", "us-west-2", "docker.io")
+		srv.dryRunNamespaces = []string{"kube-*"}
+		checkMutatePatch(t, srv, pod, map[string]string{
+			"/spec/containers/0/image": "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx:1.27",
+		})
+
+		srv.dryRunNamespaces = []string{"kube-*", "def*"}
+		out := reviewPod(t, srv, pod)
+		if len(out.Response.Patch) != 0 && string(out.Response.Patch) != "[]" {
+			t.Fatalf("expected empty patch, got %s", out.Response.Patch)
+		}
+		if len(out.Response.Warnings) != 1 {
+			t.Fatalf("warnings = %q, want one", out.Response.Warnings)
+		}
+	})
+
+	t.Run("rejections become warnings", func(t *testing.T) {
+		srv := setupServerWithRules(t,
+			[]registryConfig{{Host: "docker.io"}},
+			[]ruleConfig{{Match: "docker.io/licensed/**", Action: actionDeny, Message: "licence forbids caching"}})
+		srv.dryRun = true
+		denied := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "tool", Image: "licensed/tool:1"}},
+			},
+		}
+		out := reviewPod(t, srv, denied)
+		if !out.Response.Allowed {
+			t.Fatalf("expected pod to be allowed in dry run, got %v", out.Response.Result)
+		}
+		if len(out.Response.Warnings) != 1 || !strings.HasPrefix(out.Response.Warnings[0], "dry run: would be rejected: ") ||
+			!strings.Contains(out.Response.Warnings[0], "licence forbids caching") {
+			t.Fatalf("warnings = %q, want a rejection warning", out.Response.Warnings)
+		}
+		if _, ok := out.Response.AuditAnnotations["dry-run-rejections"]; !ok {
+			t.Fatalf("audit annotations = %v, want dry-run-rejections", out.Response.AuditAnnotations)
+		}
+	})
+
+	t.Run("nothing to rewrite", func(t *testing.T) {
+		srv := setupServer(t, "123456789012", "us-west-2", "ghcr.io")
+		srv.dryRun = true
+		out := reviewPod(t, srv, pod)
+		if len(out.Response.AuditAnnotations) != 0 {
+			t.Fatalf("unexpected audit annotations: %v", out.Response.AuditAnnotations)
+		}
+		want := `container "app": image "nginx:1.27" was not rewritten, registry docker.io is not configured`
+		if !slices.Equal(out.Response.Warnings, []string{want}) {
+			t.Fatalf("warnings = %q, want only %q", out.Response.Warnings, want)
+		}
+	})
+}
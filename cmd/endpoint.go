@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ecrEndpoint selects which of the ECR registry endpoints of a region images
+// are rewritten to.
+type ecrEndpoint string
+
+const (
+	// endpointStandard is <account>.dkr.ecr.<region>.<dns suffix>.
+	endpointStandard ecrEndpoint = "standard"
+	// endpointFIPS is <account>.dkr.ecr-fips.<region>.<dns suffix>, available
+	// in the US commercial and GovCloud regions, see awsPartition.hasFIPS.
+	endpointFIPS ecrEndpoint = "fips"
+	// endpointDualStack is the IPv4 and IPv6 endpoint
+	// <account>.dkr-ecr.<region>.<dual-stack suffix>.
+	endpointDualStack ecrEndpoint = "dualstack"
+)
+
+// awsPartition holds the DNS names ECR uses in an AWS partition.
+type awsPartition struct {
+	name string
+	// regionPrefix selects the partition's regions; "" matches the rest.
+	regionPrefix    string
+	dnsSuffix       string
+	dualStackSuffix string
+	// fipsRegions lists the regions with FIPS endpoints; allFIPS is set when
+	// every region of the partition has them.
+	fipsRegions []string
+	allFIPS     bool
+}
+
+// hasFIPS reports whether region of the partition has FIPS endpoints.
+func (p awsPartition) hasFIPS(region string) bool {
+	return p.allFIPS || slices.Contains(p.fipsRegions, region)
+}
+
+// awsPartitions lists the partitions whose ECR hostnames can be derived,
+// the catch-all commercial partition last. Isolated partitions need
+// ecrHostname.
+var awsPartitions = []awsPartition{
+	{name: "aws-cn", regionPrefix: "cn-", dnsSuffix: "amazonaws.com.cn", dualStackSuffix: "on.amazonwebservices.com.cn"},
+	{name: "aws-us-gov", regionPrefix: "us-gov-", dnsSuffix: "amazonaws.com", dualStackSuffix: "on.aws", allFIPS: true},
+	{name: "aws-iso", regionPrefix: "us-iso-"},
+	{name: "aws-iso-b", regionPrefix: "us-isob-"},
+	{name: "aws-iso-e", regionPrefix: "eu-isoe-"},
+	{name: "aws-iso-f", regionPrefix: "us-isof-"},
+	{name: "aws", dnsSuffix: "amazonaws.com", dualStackSuffix: "on.aws", fipsRegions: []string{"us-east-1", "us-east-2", "us-west-1", "us-west-2"}},
+}
+
+// ecrHostnamePattern matches the shape of ECR registry hostnames of every
+// endpoint in the partitions of awsPartitions, capturing the account ID, the
+// service name, the region and the DNS suffix. parseECRHostname also checks
+// that the suffix belongs to the region and endpoint.
+var ecrHostnamePattern = regexp.MustCompile(`^([0-9]{12})\.(dkr\.ecr|dkr\.ecr-fips|dkr-ecr)\.([a-z]{2}(?:-[a-z]+)+-[0-9]+)\.(amazonaws\.com|amazonaws\.com\.cn|on\.aws|on\.amazonwebservices\.com\.cn)$`)
+
+// ecrServiceEndpoints maps the service name in ECR hostnames to its endpoint.
+var ecrServiceEndpoints = map[string]ecrEndpoint{
+	"dkr.ecr":      endpointStandard,
+	"dkr.ecr-fips": endpointFIPS,
+	"dkr-ecr":      endpointDualStack,
+}
+
+// ecrRegistry is a parsed ECR registry hostname.
+type ecrRegistry struct {
+	AccountID string
+	Region    string
+	Partition string
+	Endpoint  ecrEndpoint
+}
+
+// parseECRHostname parses an ECR registry hostname such as
+// 123456789012.dkr.ecr.us-east-1.amazonaws.com. Hostnames of another shape,
+// or whose DNS suffix or endpoint does not exist in the partition of their
+// region, such as 123456789012.dkr.ecr.cn-north-1.amazonaws.com, are
+// rejected.
+func parseECRHostname(hostname string) (ecrRegistry, bool) {
+	m := ecrHostnamePattern.FindStringSubmatch(hostname)
+	if m == nil {
+		return ecrRegistry{}, false
+	}
+	p := partitionOf(m[3])
+	r := ecrRegistry{
+		AccountID: m[1],
+		Region:    m[3],
+		Partition: p.name,
+		Endpoint:  ecrServiceEndpoints[m[2]],
+	}
+	if p.dnsSuffix == "" || r.Endpoint == endpointFIPS && !p.hasFIPS(r.Region) || ecrHostname(r.AccountID, r.Region, r.Endpoint) != hostname+"/" {
+		return ecrRegistry{}, false
+	}
+	return r, true
+}
+
+// sameRegistry reports whether r and o are the same registry, possibly
+// reached through different endpoints.
+func (r ecrRegistry) sameRegistry(o ecrRegistry) bool {
+	return r.AccountID == o.AccountID && r.Region == o.Region && r.Partition == o.Partition
+}
+
+// pullThroughFrom describes how images of upstream reach the pull-through
+// cache of r, and whether they can: ECR-to-ECR pull-through cache rules do
+// not cross partitions.
+func (r ecrRegistry) pullThroughFrom(upstream ecrRegistry) (string, bool) {
+	switch {
+	case upstream.Partition != r.Partition:
+		return fmt.Sprintf("ECR registry %s is in partition %s, pull-through caches in %s cannot reach it", upstream.hostname(), upstream.Partition, r.Partition), false
+	case upstream.AccountID == r.AccountID:
+		return fmt.Sprintf("cross-region pull-through from %s", upstream.Region), true
+	}
+	return fmt.Sprintf("cross-account pull-through from account %s in %s", upstream.AccountID, upstream.Region), true
+}
+
+// hostname returns the hostname r was parsed from.
+func (r ecrRegistry) hostname() string {
+	return strings.TrimSuffix(ecrHostname(r.AccountID, r.Region, r.Endpoint), "/")
+}
+
+// partitionOf returns the partition of a region.
+func partitionOf(region string) awsPartition {
+	for _, p := range awsPartitions {
+		if strings.HasPrefix(region, p.regionPrefix) {
+			return p
+		}
+	}
+	panic("unreachable: the aws partition matches every region")
+}
+
+// ecrHostname returns the ECR registry of an account and region at the
+// given endpoint, with a trailing slash.
+func ecrHostname(accountID, region string, endpoint ecrEndpoint) string {
+	p := partitionOf(region)
+	switch endpoint {
+	case endpointFIPS:
+		return fmt.Sprintf("%s.dkr.ecr-fips.%s.%s/", accountID, region, p.dnsSuffix)
+	case endpointDualStack:
+		return fmt.Sprintf("%s.dkr-ecr.%s.%s/", accountID, region, p.dualStackSuffix)
+	default:
+		return fmt.Sprintf("%s.dkr.ecr.%s.%s/", accountID, region, p.dnsSuffix)
+	}
+}
+
+// validateEndpoint reports an endpoint the partition of region does not
+// offer, prefixed with key.
+func validateEndpoint(key, region string, endpoint ecrEndpoint) error {
+	if !regionPattern.MatchString(region) {
+		// Reported by the region check.
+		return nil
+	}
+	p := partitionOf(region)
+	switch {
+	case p.dnsSuffix == "":
+		return fmt.Errorf("%s: region %q is in partition %s, set ecrHostname to its ECR registry", key, region, p.name)
+	case endpoint == endpointFIPS && !p.hasFIPS(region):
+		return fmt.Errorf("%s: region %q has no FIPS endpoints", key, region)
+	}
+	return nil
+}
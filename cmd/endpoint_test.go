@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestECRHostname(t *testing.T) {
+	tests := []struct {
+		region   string
+		endpoint ecrEndpoint
+		want     string
+	}{
+		{"us-east-1", "", "123456789012.dkr.ecr.us-east-1.amazonaws.com/"},
+		{"us-east-1", endpointStandard, "123456789012.dkr.ecr.us-east-1.amazonaws.com/"},
+		{"us-east-1", endpointFIPS, "123456789012.dkr.ecr-fips.us-east-1.amazonaws.com/"},
+		{"eu-west-1", endpointDualStack, "123456789012.dkr-ecr.eu-west-1.on.aws/"},
+		{"cn-north-1", endpointStandard, "123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn/"},
+		{"cn-northwest-1", endpointDualStack, "123456789012.dkr-ecr.cn-northwest-1.on.amazonwebservices.com.cn/"},
+		{"us-gov-west-1", endpointStandard, "123456789012.dkr.ecr.us-gov-west-1.amazonaws.com/"},
+		{"us-gov-east-1", endpointFIPS, "123456789012.dkr.ecr-fips.us-gov-east-1.amazonaws.com/"},
+	}
+	for _, tt := range tests {
+		if got := ecrHostname("123456789012", tt.region, tt.endpoint); got != tt.want {
+			t.Errorf("ecrHostname(%q, %q) = %q, want %q", tt.region, tt.endpoint, got, tt.want)
+		}
+	}
+}
+
+func TestParseECRHostname(t *testing.T) {
+	tests := []struct {
+		hostname string
+		want     ecrRegistry
+		ok       bool
+	}{
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com", ecrRegistry{"123456789012", "us-east-1", "aws", endpointStandard}, true},
+		{"123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com", ecrRegistry{"123456789012", "us-gov-west-1", "aws-us-gov", endpointFIPS}, true},
+		{"123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn", ecrRegistry{"123456789012", "cn-north-1", "aws-cn", endpointStandard}, true},
+		{"123456789012.dkr-ecr.eu-west-1.on.aws", ecrRegistry{"123456789012", "eu-west-1", "aws", endpointDualStack}, true},
+		{"123456789012.dkr-ecr.cn-north-1.on.amazonwebservices.com.cn", ecrRegistry{"123456789012", "cn-north-1", "aws-cn", endpointDualStack}, true},
+		// Lookalikes and suffixes that do not belong to the region or endpoint.
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com.evil.example", ecrRegistry{}, false},
+		{"mirror.dkr.ecr.us-east-1.amazonaws.com", ecrRegistry{}, false},
+		{"12345.dkr.ecr.us-east-1.amazonaws.com", ecrRegistry{}, false},
+		{"evil.example/123456789012.dkr.ecr.us-east-1.amazonaws.com", ecrRegistry{}, false},
+		{"123456789012.dkr.ecr.cn-north-1.amazonaws.com", ecrRegistry{}, false},
+		{"123456789012.dkr.ecr.us-east-1.on.aws", ecrRegistry{}, false},
+		{"123456789012.dkr.ecr-fips.cn-north-1.amazonaws.com.cn", ecrRegistry{}, false},
+		{"123456789012.dkr.ecr-fips.eu-west-1.amazonaws.com", ecrRegistry{}, false},
+		{"123456789012.dkr.ecr.us-iso-east-1.amazonaws.com", ecrRegistry{}, false},
+		{"vpce-0a1b2c3d-4e5f6a7b.dkr.ecr.us-east-1.vpce.amazonaws.com", ecrRegistry{}, false},
+		{"public.ecr.aws", ecrRegistry{}, false},
+		{"docker.io", ecrRegistry{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseECRHostname(tt.hostname)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseECRHostname(%q) = %+v, %v, want %+v, %v", tt.hostname, got, ok, tt.want, tt.ok)
+		}
+		if isEcrRegistry(tt.hostname) != tt.ok {
+			t.Errorf("isEcrRegistry(%q) = %v, want %v", tt.hostname, !tt.ok, tt.ok)
+		}
+	}
+}
+
+func TestEvaluateImage_ECRUpstreams(t *testing.T) {
+	srv := setupServer(t, "123456789012", "us-east-1", "docker.io,123456789012.dkr.ecr.eu-west-1.amazonaws.com,210987654321.dkr.ecr.eu-west-1.amazonaws.com,123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn")
+
+	tests := []struct {
+		image      string
+		action     ruleAction
+		rewritten  string
+		reason     string
+		wantCached bool
+	}{
+		{
+			image:      "123456789012.dkr-ecr.us-east-1.on.aws/team/app:1",
+			action:     actionSkip,
+			reason:     "already uses the pull-through cache through 123456789012.dkr-ecr.us-east-1.on.aws",
+			wantCached: true,
+		},
+		{
+			image:      "123456789012.dkr.ecr-fips.us-east-1.amazonaws.com/team/app:1",
+			action:     actionSkip,
+			reason:     "already uses the pull-through cache through 123456789012.dkr.ecr-fips.us-east-1.amazonaws.com",
+			wantCached: true,
+		},
+		{
+			image:     "123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/app:1",
+			action:    actionRewrite,
+			rewritten: "123456789012.dkr.ecr.us-east-1.amazonaws.com/team/app:1",
+			reason:    "registry 123456789012.dkr.ecr.eu-west-1.amazonaws.com is configured, cross-region pull-through from eu-west-1",
+		},
+		{
+			image:     "210987654321.dkr.ecr.eu-west-1.amazonaws.com/team/app:1",
+			action:    actionRewrite,
+			rewritten: "123456789012.dkr.ecr.us-east-1.amazonaws.com/team/app:1",
+			reason:    "registry 210987654321.dkr.ecr.eu-west-1.amazonaws.com is configured, cross-account pull-through from account 210987654321 in eu-west-1",
+		},
+		{
+			image:  "123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn/team/app:1",
+			action: actionSkip,
+			reason: "ECR registry 123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn is in partition aws-cn, pull-through caches in aws cannot reach it",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			d, err := srv.evaluateImage(tt.image)
+			if err != nil {
+				t.Fatalf("evaluateImage(%q): %v", tt.image, err)
+			}
+			if d.Action != tt.action || d.Image != tt.rewritten || d.Reason != tt.reason || d.Cached != tt.wantCached {
+				t.Errorf("evaluateImage(%q) = %+v, want action %s, image %q, reason %q, cached %v", tt.image, d, tt.action, tt.rewritten, tt.reason, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestMutate_ECRHostname(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "app", Image: "nginx:1.27"},
+			// ECR images of other endpoints keep their path without a prefix.
+			{Name: "sidecar", Image: "210987654321.dkr-ecr.eu-west-1.on.aws/team/app:1"},
+		}},
+	}
+
+	t.Run("derived from the partition", func(t *testing.T) {
+		srv, err := newServerFromConfig(&config{AWSAccountID: "123456789012", AWSRegion: "cn-north-1", ECREndpoint: endpointDualStack, Registries: []registryConfig{{Host: "docker.io"}}})
+		if err != nil {
+			t.Fatalf("newServerFromConfig: %v", err)
+		}
+		checkMutatePatch(t, srv, pod, map[string]string{
+			"/spec/containers/0/image": "123456789012.dkr-ecr.cn-north-1.on.amazonwebservices.com.cn/docker.io/library/nginx:1.27",
+		})
+	})
+
+	t.Run("override", func(t *testing.T) {
+		clearConfigEnv(t)
+		cfg, err := loadConfig(writeConfig(t, "awsAccountId: \"123456789012\"\nawsRegion: us-east-1\necrHostname: ecr.internal.example.com/\nregistries: [docker.io, 210987654321.dkr-ecr.eu-west-1.on.aws]\n"), true)
+		if err != nil {
+			t.Fatalf("loadConfig: %v", err)
+		}
+		srv, err := newServerFromConfig(cfg)
+		if err != nil {
+			t.Fatalf("newServerFromConfig: %v", err)
+		}
+		checkMutatePatch(t, srv, pod, map[string]string{
+			"/spec/containers/0/image": "ecr.internal.example.com/docker.io/library/nginx:1.27",
+			"/spec/containers/1/image": "ecr.internal.example.com/team/app:1",
+		})
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	admissionv1 "k8s.io/api/admission/v1"
 	v1beta1 "k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -16,15 +17,16 @@ import (
 
 // setupHTTPServer prepares config and starts an httptest server with the mutate handler.
 func setupHTTPServer(t *testing.T) *httptest.Server {
-	srv := setupServer(t, "99999", "eu-central-1", "ghcr.io,docker.io")
+	srv := setupServer(t, "999999999999", "eu-central-1", "ghcr.io,docker.io")
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/mutate", srv.handleMutate)
+	mux.HandleFunc("/validate", srv.handleValidate)
 	return httptest.NewServer(mux)
 }
 
 // doMutate posts the given pod to the test server and returns the parsed patches.
-func doMutate(t *testing.T, srvURL string, pod *corev1.Pod) []map[string]string {
+func doMutate(t *testing.T, srvURL string, pod *corev1.Pod) []patchOperation {
 	t.Helper()
 	podJSON, err := json.Marshal(pod)
 	if err != nil {
@@ -66,7 +68,7 @@ func doMutate(t *testing.T, srvURL string, pod *corev1.Pod) []map[string]string
 		t.Fatalf("mutation not allowed")
 	}
 
-	var patches []map[string]string
+	var patches []patchOperation
 	if err := json.Unmarshal(out.Response.Patch, &patches); err != nil {
 		t.Fatalf("unmarshal patch: %v", err)
 	}
@@ -74,10 +76,11 @@ func doMutate(t *testing.T, srvURL string, pod *corev1.Pod) []map[string]string
 	return patches
 }
 
-func findPatchValue(patches []map[string]string, path string) (string, bool) {
+func findPatchValue(patches []patchOperation, path string) (string, bool) {
 	for _, p := range patches {
-		if p["path"] == path {
-			return p["value"], true
+		if p.Path == path {
+			v, _ := p.Value.(string)
+			return v, true
 		}
 	}
 	return "", false
@@ -99,14 +102,14 @@ func TestMutateHandler_Containers(t *testing.T) {
 
 	patches := doMutate(t, ts.URL, pod)
 
-	want0 := "99999.dkr.ecr.eu-central-1.amazonaws.com/docker.io/library/nginx:latest"
+	want0 := "999999999999.dkr.ecr.eu-central-1.amazonaws.com/docker.io/library/nginx:latest"
 	if got, ok := findPatchValue(patches, "/spec/containers/0/image"); !ok {
 		t.Fatalf("missing patch for containers/0")
 	} else if got != want0 {
 		t.Fatalf("containers/0 got=%q want=%q", got, want0)
 	}
 
-	want1 := "99999.dkr.ecr.eu-central-1.amazonaws.com/ghcr.io/owner/app:1.0"
+	want1 := "999999999999.dkr.ecr.eu-central-1.amazonaws.com/ghcr.io/owner/app:1.0"
 	if got, ok := findPatchValue(patches, "/spec/containers/1/image"); !ok {
 		t.Fatalf("missing patch for containers/1")
 	} else if got != want1 {
@@ -127,7 +130,7 @@ func TestMutateHandler_InitContainers(t *testing.T) {
 
 	patches := doMutate(t, ts.URL, pod)
 
-	wantInit := "99999.dkr.ecr.eu-central-1.amazonaws.com/docker.io/owner/init:0.1"
+	wantInit := "999999999999.dkr.ecr.eu-central-1.amazonaws.com/docker.io/owner/init:0.1"
 	if got, ok := findPatchValue(patches, "/spec/initContainers/0/image"); !ok {
 		t.Fatalf("missing patch for initContainers/0")
 	} else if got != wantInit {
@@ -135,6 +138,85 @@ func TestMutateHandler_InitContainers(t *testing.T) {
 	}
 }
 
+func TestMutateHandler_AdmissionReviewVersions(t *testing.T) {
+	ts := setupHTTPServer(t)
+	defer ts.Close()
+
+	podJSON, err := json.Marshal(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "int-pod-v", Namespace: "default"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "nginx"}}},
+	})
+	if err != nil {
+		t.Fatalf("marshal pod: %v", err)
+	}
+	want := "999999999999.dkr.ecr.eu-central-1.amazonaws.com/docker.io/library/nginx"
+
+	t.Run("v1beta1", func(t *testing.T) {
+		review := v1beta1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"},
+			Request:  &v1beta1.AdmissionRequest{UID: "u1", Object: runtime.RawExtension{Raw: podJSON}},
+		}
+		var out v1beta1.AdmissionReview
+		postReview(t, ts.URL+"/mutate", review, &out)
+		if out.APIVersion != "admission.k8s.io/v1beta1" {
+			t.Fatalf("apiVersion = %q", out.APIVersion)
+		}
+		if out.Response == nil || out.Response.UID != "u1" || !out.Response.Allowed {
+			t.Fatalf("unexpected response: %+v", out.Response)
+		}
+		var patches []patchOperation
+		if err := json.Unmarshal(out.Response.Patch, &patches); err != nil {
+			t.Fatalf("unmarshal patch: %v", err)
+		}
+		if got, _ := findPatchValue(patches, "/spec/containers/0/image"); got != want {
+			t.Fatalf("containers/0 got=%q want=%q", got, want)
+		}
+	})
+
+	t.Run("v1", func(t *testing.T) {
+		review := admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+			Request:  &admissionv1.AdmissionRequest{UID: "u2", Object: runtime.RawExtension{Raw: podJSON}},
+		}
+		var out admissionv1.AdmissionReview
+		postReview(t, ts.URL+"/mutate", review, &out)
+		if out.APIVersion != "admission.k8s.io/v1" {
+			t.Fatalf("apiVersion = %q", out.APIVersion)
+		}
+		if out.Response == nil || out.Response.UID != "u2" || !out.Response.Allowed {
+			t.Fatalf("unexpected response: %+v", out.Response)
+		}
+		var patches []patchOperation
+		if err := json.Unmarshal(out.Response.Patch, &patches); err != nil {
+			t.Fatalf("unmarshal patch: %v", err)
+		}
+		if got, _ := findPatchValue(patches, "/spec/containers/0/image"); got != want {
+			t.Fatalf("containers/0 got=%q want=%q", got, want)
+		}
+	})
+}
+
+// postReview posts review to a webhook endpoint of the test server and
+// decodes the answer into out.
+func postReview(t *testing.T, url string, review, out any) {
+	t.Helper()
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatalf("marshal review: %v", err)
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("post review: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+}
+
 func TestMutateHandler_UnconfiguredRegistryIgnored(t *testing.T) {
 	ts := setupHTTPServer(t)
 	defer ts.Close()
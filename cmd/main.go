@@ -1,6 +1,7 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"encoding/json"
@@ -13,22 +14,47 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"slices"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	admissionv1 "k8s.io/api/admission/v1"
-	corev1 "k8s.io/api/core/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 const dockerHubRegistry = "docker.io/"
 
 type server struct {
-	registries          []string
+	cfg        *config
+	registries []string
+	// prefixes maps each entry of registries to the ECR repository prefix,
+	// including its trailing slash, under which its images are cached.
+	prefixes map[string]string
+	// aliases maps registry hostnames to the canonical hostname images are
+	// matched and cached under.
+	aliases          map[string]string
+	rules            []imageRule
+	customResources  []customResourceRule
+	dryRun           bool
+	dryRunNamespaces []string
+	validationScope  validationScope
+	// ecrRegistryHostname is the ECR registry of the default target, with a
+	// trailing slash.
 	ecrRegistryHostname string
+	// targets maps the name of every ECR target, including "default", to
+	// its registry.
+	targets          map[string]ecrTarget
+	namespaceTargets map[string]string
+	// namespaces looks up the labels and annotations naming a namespace's
+	// target; nil outside the cluster.
+	namespaces namespaceLookup
+	// digests pins rewritten images to digests, nil unless pinDigests is enabled.
+	digests *digestResolver
 }
 
 type CertReloader struct {
@@ -40,35 +66,73 @@ type CertReloader struct {
 }
 
 func newServer() (*server, error) {
-	accountID := os.Getenv("ECR_AWS_ACCOUNT_ID")
-	if accountID == "" {
-		return nil, fmt.Errorf("ECR_AWS_ACCOUNT_ID is required")
+	path, required := configPath()
+	cfg, err := loadConfig(path, required)
+	if err != nil {
+		return nil, err
 	}
+	return newServerFromConfig(cfg)
+}
 
-	region := os.Getenv("ECR_AWS_REGION")
-	if region == "" {
-		return nil, fmt.Errorf("ECR_AWS_REGION is required")
+func newServerFromConfig(cfg *config) (*server, error) {
+	rules, err := compileRules(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	customResources, err := compileCustomResources(cfg.CustomResources)
+	if err != nil {
+		return nil, err
 	}
 
-	var registries []string
-	if raw := os.Getenv("ECR_REGISTRIES"); raw != "" {
-		for r := range strings.SplitSeq(raw, ",") {
-			r = strings.TrimSpace(r)
-			if r != "" {
-				registries = append(registries, strings.TrimRight(r, "/")+"/")
-			}
+	registries := make([]string, 0, len(cfg.Registries))
+	prefixes := make(map[string]string, len(cfg.Registries))
+	for _, r := range cfg.Registries {
+		registry := r.Host + "/"
+		registries = append(registries, registry)
+		if r.Prefix != "" {
+			prefixes[registry] = r.Prefix + "/"
+		} else {
+			prefixes[registry] = defaultPrefix(registry)
 		}
 	}
-	if len(registries) == 0 {
-		registries = []string{dockerHubRegistry}
+
+	targets := map[string]ecrTarget{defaultTarget: cfg.defaultTarget().target(cfg.ECREndpoint)}
+	for _, t := range cfg.Targets {
+		targets[t.Name] = t.target(cfg.ECREndpoint)
+	}
+
+	var digests *digestResolver
+	if cfg.PinDigests.Enabled {
+		digests = newDigestResolver(cfg.PinDigests)
 	}
 
 	return &server{
+		cfg:                 cfg,
 		registries:          registries,
-		ecrRegistryHostname: fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com/", accountID, region),
+		prefixes:            prefixes,
+		rules:               rules,
+		customResources:     customResources,
+		dryRun:              cfg.DryRun,
+		dryRunNamespaces:    cfg.DryRunNamespaces,
+		validationScope:     cmp.Or(cfg.ValidationScope, scopeConfigured),
+		ecrRegistryHostname: targets[defaultTarget].hostname,
+		aliases:             cfg.registryAliases(),
+		targets:             targets,
+		namespaceTargets:    cfg.NamespaceTargets,
+		digests:             digests,
 	}, nil
 }
 
+// defaultPrefix returns the cache prefix of a registry, with its trailing
+// slash, without an explicit one: its hostname, or nothing for ECR-to-ECR
+// pull-through, which keeps the upstream repository path as is.
+func defaultPrefix(registry string) string {
+	if isEcrRegistry(strings.TrimSuffix(registry, "/")) {
+		return ""
+	}
+	return registry
+}
+
 func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
 	stat, err := os.Stat(cr.certPath)
 	if err != nil {
@@ -91,8 +155,10 @@ func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate,
 	}
 	pair, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
 	if err != nil {
+		observeCertificate(nil)
 		return nil, fmt.Errorf("failed loading tls key pair: %w", err)
 	}
+	observeCertificate(&pair)
 	cr.cachedCert = &pair
 	cr.cachedCertModTime = stat.ModTime()
 	slog.Info("TLS certificate loaded")
@@ -107,44 +173,132 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// isEcrRegistry reports whether the given registry hostname belongs to an ECR endpoint.
+// isEcrRegistry reports whether the given registry hostname is an ECR
+// registry, see parseECRHostname.
 func isEcrRegistry(registry string) bool {
-	return strings.Contains(registry, ".dkr.ecr.")
+	_, ok := parseECRHostname(registry)
+	return ok
+}
+
+// imageDecision describes what the webhook does with an image and why.
+type imageDecision struct {
+	Action ruleAction
+	Image  string // rewritten image, set when Action is actionRewrite
+	Rule   string // rule that decided, empty when the registry list did
+	Reason string
+	// Unconfigured is set when an image from a non-ECR registry is skipped
+	// only because its registry is not configured.
+	Unconfigured bool
+	// Cached is set when the image already uses the pull-through cache.
+	Cached bool
 }
 
-// rewriteImage normalizes the image, checks whether its registry is in the
-// configured list, and returns the pull-through cache path. Returns ("", false)
-// when the image's registry is not configured.
-func (s *server) rewriteImage(image string) (string, bool) {
-	var registry, path string
-	i := strings.IndexByte(image, '/') + 1
-	if i == 0 {
-		// bare image: "nginx" → docker.io/, library/nginx
-		registry = dockerHubRegistry
-		path = "library/" + image
-	} else {
-		registry = image[:i]
-		path = image[i:]
-		if !strings.Contains(registry, ".") && !strings.Contains(registry, ":") {
-			// no registry specified, implicit Docker Hub: "owner/image" → docker.io/, owner/image
-			registry = dockerHubRegistry
-			path = image
-		} else if registry == dockerHubRegistry && !strings.Contains(path, "/") {
-			// docker.io/nginx → docker.io/, library/nginx
-			path = "library/" + path
+// errImageDenied is wrapped by rewriteImage for images matched by a deny rule.
+var errImageDenied = errors.New("denied")
+
+// evaluateImage decides what happens to image with the default target, see
+// evaluateImageAt.
+func (s *server) evaluateImage(image string) (imageDecision, error) {
+	return s.evaluateImageAt(image, s.targets[defaultTarget])
+}
+
+// evaluateImageAt parses the image and decides whether it is rewritten to
+// the pull-through cache path <ecr>/<prefix>/<path> of target, left alone or
+// denied. The first matching rule wins; without one, images from configured
+// registries are rewritten. Images of the target's own ECR registry, through
+// any endpoint, are left alone, and images of ECR registries in another
+// partition cannot be rewritten. An error is returned only for invalid
+// references.
+func (s *server) evaluateImageAt(image string, target ecrTarget) (imageDecision, error) {
+	ref, err := s.parseImage(image)
+	if err != nil {
+		return imageDecision{}, err
+	}
+	if strings.HasPrefix(image, target.hostname) {
+		return imageDecision{Action: actionSkip, Reason: "already uses the pull-through cache", Cached: true}, nil
+	}
+	upstream, isECR := parseECRHostname(ref.Domain)
+	if isECR && upstream.sameRegistry(target.registry) {
+		return imageDecision{Action: actionSkip, Reason: fmt.Sprintf("already uses the pull-through cache through %s", ref.Domain), Cached: true}, nil
+	}
+
+	registry := ref.Domain + "/"
+	prefix, configured := s.prefixes[registry]
+	rule, matched := matchRule(s.rules, ref.Name())
+	var d imageDecision
+	switch {
+	case matched:
+		d = imageDecision{Action: rule.action, Rule: rule.name}
+		switch rule.action {
+		case actionRewrite:
+			if !configured {
+				prefix = defaultPrefix(registry)
+			}
+			d.Reason = "matched rewrite rule"
+		case actionSkip:
+			d.Reason = "matched skip rule"
+		case actionDeny:
+			d.Reason = cmp.Or(rule.message, "matched deny rule")
+		}
+	case !configured:
+		return imageDecision{
+			Action:       actionSkip,
+			Reason:       fmt.Sprintf("registry %s is not configured", ref.Domain),
+			Unconfigured: !isECR,
+		}, nil
+	default:
+		d = imageDecision{Action: actionRewrite, Reason: fmt.Sprintf("registry %s is configured", ref.Domain)}
+	}
+	if d.Action != actionRewrite {
+		return d, nil
+	}
+	if isECR {
+		reason, ok := target.registry.pullThroughFrom(upstream)
+		if !ok {
+			return imageDecision{Action: actionSkip, Rule: d.Rule, Reason: reason}, nil
 		}
+		d.Reason += ", " + reason
 	}
+	d.Image = target.hostname + prefix + ref.Path + ref.Suffix()
+	return d, nil
+}
+
+// rewriteImage returns the path of image in the pull-through cache of the
+// default target, see rewriteImageAt.
+func (s *server) rewriteImage(image string) (string, bool, error) {
+	return s.rewriteImageAt(image, s.targets[defaultTarget])
+}
 
-	if !slices.Contains(s.registries, registry) {
-		return "", false
+// rewriteImageAt returns the path of image in the pull-through cache of
+// target. Returns ("", false, nil) when the image is left alone, and an error
+// when the image is not a valid reference or is denied by a rule.
+func (s *server) rewriteImageAt(image string, target ecrTarget) (string, bool, error) {
+	d, err := s.evaluateImageAt(image, target)
+	if err != nil {
+		return "", false, err
 	}
-	if isEcrRegistry(registry) {
-		return s.ecrRegistryHostname + path, true
+	switch d.Action {
+	case actionRewrite:
+		return d.Image, true, nil
+	case actionDeny:
+		return "", false, denyError(image, d)
 	}
-	return s.ecrRegistryHostname + registry + path, true
+	return "", false, nil
+}
+
+// denyError is the error reported for an image denied by a rule.
+func denyError(image string, d imageDecision) error {
+	return fmt.Errorf("image %q %w by %s: %s", image, errImageDenied, d.Rule, d.Reason)
 }
 
 func (s *server) handleMutate(w http.ResponseWriter, r *http.Request) {
+	serveReview(w, r, "mutate", s.mutate)
+}
+
+// serveReview reads an AdmissionReview from r, passes it to review and
+// writes the AdmissionReview it returns.
+func serveReview(w http.ResponseWriter, r *http.Request, op string, review func(body []byte) ([]byte, error)) {
+	defer observeDuration(op, time.Now())
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -161,6 +315,7 @@ func (s *server) handleMutate(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		var maxBytesErr *http.MaxBytesError
 		if errors.As(err, &maxBytesErr) {
+			requestsTooLarge.WithLabelValues(op).Inc()
 			w.WriteHeader(http.StatusRequestEntityTooLarge)
 		} else {
 			slog.Error("failed to read request body", "error", err)
@@ -169,64 +324,205 @@ func (s *server) handleMutate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mutated, err := s.mutate(body)
+	out, err := review(body)
 	if err != nil {
-		slog.Error("failed to mutate request", "error", err)
+		slog.Error("failed to "+op+" request", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "%s", err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	w.Write(mutated)
+	w.Write(out)
 }
 
-func (s *server) mutate(body []byte) ([]byte, error) {
+// imageFields decodes raw according to gvk and returns its image fields. obj
+// is nil for kinds without a pod spec, whose fields come from the
+// customResources config.
+func (s *server) imageFields(gvk metav1.GroupVersionKind, raw []byte) (obj *workload, fields []imageField, err error) {
+	obj, err = decodeWorkload(gvk, raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if obj != nil {
+		forEachContainer(obj.podSpec, obj.specPath, func(container, image, path string) {
+			fields = append(fields, imageField{path: path, image: image, container: container})
+		})
+		return obj, fields, nil
+	}
+	if rule, ok := findCustomResource(s.customResources, gvk); ok {
+		fields, err = findImageFields(rule, raw)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return nil, fields, nil
+}
+
+// previousImages returns the images of the object before an UPDATE by JSON
+// pointer, and nil for other operations.
+func (s *server) previousImages(ar *admissionv1.AdmissionRequest) (map[string]string, error) {
+	if ar.Operation != admissionv1.Update || len(ar.OldObject.Raw) == 0 {
+		return nil, nil
+	}
+	_, fields, err := s.imageFields(ar.Kind, ar.OldObject.Raw)
+	if err != nil {
+		return nil, err
+	}
+	previous := map[string]string{}
+	for _, f := range fields {
+		previous[f.path] = f.image
+	}
+	return previous, nil
+}
+
+// mutate rewrites the images of the admitted object to the pull-through
+// cache. On UPDATE only images that changed are rewritten: immutable
+// templates such as a Job's must not change after creation, and images the
+// webhook left alone then, e.g. while it failed open, stay as they are.
+func (s *server) mutate(body []byte) (_ []byte, err error) {
+	var ar *admissionv1.AdmissionRequest
+	resp := admissionv1.AdmissionResponse{}
+	defer func() { observeAdmission("mutate", ar, &resp, err) }()
+
 	admReview := admissionv1.AdmissionReview{}
 	if err := json.Unmarshal(body, &admReview); err != nil {
 		return nil, fmt.Errorf("unmarshaling request failed with %s", err)
 	}
-
-	var pod *corev1.Pod
+	if err := checkReviewVersion(admReview.APIVersion); err != nil {
+		return nil, err
+	}
 
 	responseBody := []byte{}
-	ar := admReview.Request
-	resp := admissionv1.AdmissionResponse{}
+	ar = admReview.Request
 
 	if ar != nil {
-		if err := json.Unmarshal(ar.Object.Raw, &pod); err != nil {
-			return nil, fmt.Errorf("unable unmarshal pod json object %v", err)
+		obj, fields, err := s.imageFields(ar.Kind, ar.Object.Raw)
+		if err != nil {
+			return nil, err
+		}
+		previous, err := s.previousImages(ar)
+		if err != nil {
+			return nil, err
 		}
-		slog.Info("received mutation request", "namespace", pod.Namespace, "pod", pod.ObjectMeta.GenerateName)
 
 		resp.Allowed = true
 		resp.UID = ar.UID
 		pT := admissionv1.PatchTypeJSONPatch
 		resp.PatchType = &pT
 
-		p := []map[string]string{}
+		namespace, kind, name := ar.Namespace, ar.Kind.Kind, ar.Name
+		if obj != nil {
+			namespace, kind, name = cmp.Or(namespace, obj.meta.Namespace), obj.kind, obj.name()
+		}
+		slog.Info("received mutation request", "namespace", namespace, "kind", kind, "name", name)
+
+		dryRun := s.isDryRun(namespace)
+		var rewrites []imageRewrite
+		var rejections, skipped []string
+		code := int32(http.StatusForbidden)
+
+		target, warning := s.targetFor(namespace)
+		if warning != "" {
+			slog.Warn("unknown namespace target", "namespace", namespace, "warning", warning)
+			skipped = append(skipped, warning)
+		}
 
-		addPatchForImage := func(image, path string) {
-			if strings.HasPrefix(image, s.ecrRegistryHostname) {
-				return
+		// Digest lookups of one request share a time budget, so a slow
+		// registry delays admission by at most its timeout.
+		ctx := context.Background()
+		if s.digests != nil {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, s.digests.timeout)
+			defer cancel()
+		}
+
+		for _, f := range fields {
+			if old, ok := previous[f.path]; f.image == "" || ok && old == f.image {
+				continue
+			}
+			d, err := s.evaluateImageAt(f.image, target)
+			if err == nil && d.Action == actionDeny {
+				err = denyError(f.image, d)
+			}
+			if err != nil {
+				rejections = append(rejections, fmt.Sprintf("%s: %s", f.label(), err))
+				if errors.Is(err, errImageDenied) {
+					s.observeImage(f.image, "denied")
+				} else {
+					s.observeImage(f.image, "invalid")
+					code = http.StatusBadRequest
+				}
+				continue
 			}
-			if newImage, ok := s.rewriteImage(image); ok {
-				p = append(p, map[string]string{"op": "replace", "path": path, "value": newImage})
-				slog.Info("patched image", "namespace", pod.Namespace, "pod", pod.ObjectMeta.GenerateName, "original", image, "new", newImage)
+			if d.Action == actionSkip {
+				s.observeImage(f.image, "skipped")
+				if d.Unconfigured {
+					skipped = append(skipped, fmt.Sprintf("%s: image %q was not rewritten, %s", f.label(), f.image, d.Reason))
+				}
+				continue
+			}
+			if s.digests != nil {
+				d.Image, err = s.pinDigest(ctx, f.image, d.Image)
+				if err != nil {
+					slog.Warn("failed to pin image digest", "namespace", namespace, "kind", kind, "name", name, "image", f.image, "error", err)
+					skipped = append(skipped, fmt.Sprintf("%s: image %q was not pinned to a digest: %s", f.label(), f.image, err))
+				}
+			}
+			rewrites = append(rewrites, imageRewrite{Path: f.path, Container: f.container, Original: f.image, Rewritten: d.Image})
+			if dryRun {
+				s.observeImage(f.image, "dry_run")
+				slog.Info("dry run: would patch image", "namespace", namespace, "kind", kind, "name", name, "original", f.image, "new", d.Image)
+			} else {
+				s.observeImage(f.image, "rewritten")
+				slog.Info("patched image", "namespace", namespace, "kind", kind, "name", name, "original", f.image, "new", d.Image)
 			}
 		}
 
-		for i, container := range pod.Spec.Containers {
-			addPatchForImage(container.Image, fmt.Sprintf("/spec/containers/%d/image", i))
+		switch {
+		case dryRun:
+			if len(rejections) > 0 {
+				slog.Warn("dry run: would reject object", "namespace", namespace, "kind", kind, "name", name, "errors", rejections)
+			}
+			resp.Warnings, resp.AuditAnnotations, err = dryRunReport(rewrites, rejections)
+			if err != nil {
+				return nil, err
+			}
+			resp.Warnings = append(resp.Warnings, skipped...)
+			rewrites = nil
+		case len(rejections) > 0:
+			slog.Warn("rejected object", "namespace", namespace, "kind", kind, "name", name, "errors", rejections)
+			resp.Allowed = false
+			resp.PatchType = nil
+			resp.Result = &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    code,
+				Reason:  statusReason(code),
+				Message: strings.Join(rejections, "; "),
+			}
+			return marshalReview(admReview, resp)
+		default:
+			resp.Warnings = skipped
+			resp.AuditAnnotations, err = auditAnnotations(rewrites)
+			if err != nil {
+				return nil, err
+			}
 		}
-		for i, initcontainer := range pod.Spec.InitContainers {
-			addPatchForImage(initcontainer.Image, fmt.Sprintf("/spec/initContainers/%d/image", i))
+
+		p := []patchOperation{}
+		for _, rw := range rewrites {
+			p = append(p, patchOperation{Op: "replace", Path: rw.Path, Value: rw.Rewritten})
 		}
-		for i, ephemeralcontainer := range pod.Spec.EphemeralContainers {
-			addPatchForImage(ephemeralcontainer.Image, fmt.Sprintf("/spec/ephemeralContainers/%d/image", i))
+		if obj != nil && !dryRun {
+			originals, recorded := s.originalImages(obj, fields, previous, rewrites, target)
+			op, err := originalImagesPatch(obj, originals, recorded)
+			if err != nil {
+				return nil, err
+			}
+			if op != nil {
+				p = append(p, *op)
+			}
 		}
-
-		var err error
 		resp.Patch, err = json.Marshal(p)
 		if err != nil {
 			return nil, fmt.Errorf("failed to marshal patch: %w", err)
@@ -236,37 +532,102 @@ func (s *server) mutate(body []byte) ([]byte, error) {
 			Status: "Success",
 		}
 
-		admReview.Response = &resp
-		admReview.TypeMeta = metav1.TypeMeta{
-			APIVersion: "admission.k8s.io/v1",
-			Kind:       "AdmissionReview",
-		}
-
-		responseBody, err = json.Marshal(admReview)
+		responseBody, err = marshalReview(admReview, resp)
 		if err != nil {
 			return nil, err
 		}
-		slog.Info("mutation complete", "namespace", pod.Namespace, "pod", pod.ObjectMeta.Name)
+		slog.Info("mutation complete", "namespace", namespace, "kind", kind, "name", name)
 	}
 
 	return responseBody, nil
 }
 
+// patchOperation is a JSON patch (RFC 6902) operation.
+type patchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value,omitempty"`
+}
+
+func statusReason(code int32) metav1.StatusReason {
+	if code == http.StatusBadRequest {
+		return metav1.StatusReasonInvalid
+	}
+	return metav1.StatusReasonForbidden
+}
+
+// checkReviewVersion rejects AdmissionReview versions other than v1 and
+// v1beta1. Both share the same JSON layout, so one Go type decodes either.
+// Reviews without an apiVersion are treated as v1.
+func checkReviewVersion(apiVersion string) error {
+	switch apiVersion {
+	case "", admissionv1.SchemeGroupVersion.String(), admissionv1beta1.SchemeGroupVersion.String():
+		return nil
+	}
+	return fmt.Errorf("unsupported AdmissionReview version %q", apiVersion)
+}
+
+// marshalReview wraps resp in an AdmissionReview answering the given request
+// in the API version the request was sent in.
+func marshalReview(admReview admissionv1.AdmissionReview, resp admissionv1.AdmissionResponse) ([]byte, error) {
+	admReview.Response = &resp
+	admReview.TypeMeta = metav1.TypeMeta{
+		APIVersion: cmp.Or(admReview.APIVersion, admissionv1.SchemeGroupVersion.String()),
+		Kind:       "AdmissionReview",
+	}
+	return json.Marshal(admReview)
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+	}
+
 	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
 
-	srv, err := newServer()
+	path, required := configPath()
+	reloader, err := newConfigReloader(path, required)
 	if err != nil {
 		slog.Error("failed to load config", "error", err)
 		os.Exit(1)
 	}
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	go reloader.Watch(watchCtx, 10*time.Second)
+
+	// Namespace labels and annotations select ECR targets when running in
+	// the cluster; elsewhere only namespaceTargets applies.
+	if restConfig, err := rest.InClusterConfig(); err == nil {
+		client, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			slog.Error("failed to create Kubernetes client", "error", err)
+			os.Exit(1)
+		}
+		reloader.SetNamespaceLookup(newNamespaceCache(client, time.Minute).Lookup)
+	}
+
+	// Webhook endpoints require an authenticated client when a client CA
+	// bundle is configured; probes and metrics stay open.
+	clientCAPath, clientSubjects := clientAuthFromEnv()
+	webhook := func(h http.HandlerFunc) http.HandlerFunc { return h }
+	var clientCAs *ClientCAReloader
+	if clientCAPath != "" {
+		clientCAs, err = newClientCAReloader(clientCAPath)
+		if err != nil {
+			slog.Error("failed to load client CA bundle", "error", err)
+			os.Exit(1)
+		}
+		webhook = func(h http.HandlerFunc) http.HandlerFunc { return requireClientCert(clientSubjects, h) }
+	}
 
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/", handleRoot)
 	mux.HandleFunc("/health", handleHealth)
 	mux.HandleFunc("/ready", handleHealth)
-	mux.HandleFunc("/mutate", srv.handleMutate)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/mutate", webhook(reloader.handleMutate))
+	mux.HandleFunc("/validate", webhook(reloader.handleValidate))
 
 	s := &http.Server{
 		Addr:           ":8443",
@@ -276,18 +637,51 @@ func main() {
 		MaxHeaderBytes: 1 << 20, // 1048576
 	}
 
-	// Check for TLS certificate and key files
-	certPath := "/etc/webhook/certs/tls.crt"
-	keyPath := "/etc/webhook/certs/tls.key"
-	_, certErr := os.Stat(certPath)
-	_, keyErr := os.Stat(keyPath)
-
-	if !os.IsNotExist(certErr) && !os.IsNotExist(keyErr) {
-		reloader := &CertReloader{certPath: certPath, keyPath: keyPath}
+	switch mode := os.Getenv("WEBHOOK_TLS_MODE"); mode {
+	case "self-managed":
+		certs, err := newSelfManagedTLSFromEnv()
+		if err != nil {
+			slog.Error("failed to configure self-managed TLS", "error", err)
+			os.Exit(1)
+		}
+		if err := certs.ensure(watchCtx); err != nil {
+			slog.Error("failed to issue TLS certificate", "error", err)
+			os.Exit(1)
+		}
+		go certs.Run(watchCtx, 5*time.Minute)
 		s.TLSConfig = &tls.Config{
-			GetCertificate: reloader.GetCertificate,
+			GetCertificate: certs.GetCertificate,
 			MinVersion:     tls.VersionTLS12,
 		}
+
+	case "", "files":
+		// Check for TLS certificate and key files
+		certPath := "/etc/webhook/certs/tls.crt"
+		keyPath := "/etc/webhook/certs/tls.key"
+		_, certErr := os.Stat(certPath)
+		_, keyErr := os.Stat(keyPath)
+
+		if !os.IsNotExist(certErr) && !os.IsNotExist(keyErr) {
+			reloader := &CertReloader{certPath: certPath, keyPath: keyPath}
+			s.TLSConfig = &tls.Config{
+				GetCertificate: reloader.GetCertificate,
+				MinVersion:     tls.VersionTLS12,
+			}
+		} else {
+			slog.Warn("no TLS certificate in /etc/webhook/certs, serving plain HTTP which the API server cannot call; mount a certificate or set WEBHOOK_TLS_MODE=self-managed")
+		}
+
+	default:
+		slog.Error("invalid WEBHOOK_TLS_MODE, expected files or self-managed", "mode", mode)
+		os.Exit(1)
+	}
+
+	if clientCAs != nil {
+		if s.TLSConfig == nil {
+			slog.Error("WEBHOOK_CLIENT_CA_FILE requires TLS, but no serving certificate is configured")
+			os.Exit(1)
+		}
+		s.TLSConfig = withClientAuth(s.TLSConfig, clientCAs)
 	}
 
 	go func() {
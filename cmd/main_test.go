@@ -15,7 +15,7 @@ func TestNewServer(t *testing.T) {
 	})
 
 	t.Run("missing region", func(t *testing.T) {
-		t.Setenv("ECR_AWS_ACCOUNT_ID", "123456")
+		t.Setenv("ECR_AWS_ACCOUNT_ID", "123456789012")
 		t.Setenv("ECR_AWS_REGION", "")
 		_, err := newServer()
 		if err == nil {
@@ -24,21 +24,21 @@ func TestNewServer(t *testing.T) {
 	})
 
 	t.Run("builds ECR hostname from account and region", func(t *testing.T) {
-		t.Setenv("ECR_AWS_ACCOUNT_ID", "123456")
+		t.Setenv("ECR_AWS_ACCOUNT_ID", "123456789012")
 		t.Setenv("ECR_AWS_REGION", "us-east-1")
 		t.Setenv("ECR_REGISTRIES", "")
 		srv, err := newServer()
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
-		want := "123456.dkr.ecr.us-east-1.amazonaws.com/"
+		want := "123456789012.dkr.ecr.us-east-1.amazonaws.com/"
 		if srv.ecrRegistryHostname != want {
 			t.Fatalf("ecrRegistryHostname = %q, want %q", srv.ecrRegistryHostname, want)
 		}
 	})
 
 	t.Run("defaults to docker.io when ECR_REGISTRIES unset", func(t *testing.T) {
-		t.Setenv("ECR_AWS_ACCOUNT_ID", "123456")
+		t.Setenv("ECR_AWS_ACCOUNT_ID", "123456789012")
 		t.Setenv("ECR_AWS_REGION", "us-east-1")
 		t.Setenv("ECR_REGISTRIES", "")
 		srv, err := newServer()
@@ -52,7 +52,7 @@ func TestNewServer(t *testing.T) {
 	})
 
 	t.Run("parses registries with trailing slash normalization", func(t *testing.T) {
-		t.Setenv("ECR_AWS_ACCOUNT_ID", "123456")
+		t.Setenv("ECR_AWS_ACCOUNT_ID", "123456789012")
 		t.Setenv("ECR_AWS_REGION", "us-east-1")
 		t.Setenv("ECR_REGISTRIES", "ghcr.io, docker.io/,quay.io")
 		srv, err := newServer()
@@ -72,7 +72,7 @@ func TestNewServer(t *testing.T) {
 	})
 
 	t.Run("filters empty entries", func(t *testing.T) {
-		t.Setenv("ECR_AWS_ACCOUNT_ID", "123456")
+		t.Setenv("ECR_AWS_ACCOUNT_ID", "123456789012")
 		t.Setenv("ECR_AWS_REGION", "us-east-1")
 		t.Setenv("ECR_REGISTRIES", "ghcr.io,,, docker.io ,")
 		srv, err := newServer()
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+const metricsNamespace = "ecr_pull_through"
+
+var (
+	admissionRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_requests_total",
+		Help:      "AdmissionReviews handled, by webhook, operation, namespace and result (patched, allowed, denied or error).",
+	}, []string{"webhook", "operation", "namespace", "result"})
+
+	imagesProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "images_total",
+		Help:      "Image references seen by the mutating webhook, by upstream registry (configured or alias target, else other or invalid) and action (rewritten, dry_run, skipped, denied or invalid).",
+	}, []string{"registry", "action"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time spent handling webhook requests.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"webhook"})
+
+	requestsTooLarge = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_body_too_large_total",
+		Help:      "Webhook requests rejected because their body exceeded the size limit.",
+	}, []string{"webhook"})
+
+	digestLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "digest_lookups_total",
+		Help:      "Tag to digest lookups for digest pinning, by result (cached, resolved or error).",
+	}, []string{"result"})
+
+	certReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificate_reloads_total",
+		Help:      "TLS certificate loads, from disk or self-managed issuance, by result (success or error).",
+	}, []string{"result"})
+
+	certExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificate_expiry_timestamp_seconds",
+		Help:      "Expiry of the serving TLS certificate as a Unix timestamp.",
+	})
+)
+
+// observeAdmission counts a handled AdmissionReview. ar is nil when the
+// review could not be decoded or carried no request.
+func observeAdmission(webhook string, ar *admissionv1.AdmissionRequest, resp *admissionv1.AdmissionResponse, err error) {
+	if ar == nil && err == nil {
+		return
+	}
+	var operation, namespace string
+	if ar != nil {
+		operation, namespace = string(ar.Operation), ar.Namespace
+	}
+	result := "allowed"
+	switch {
+	case err != nil:
+		result = "error"
+	case !resp.Allowed:
+		result = "denied"
+	case len(resp.Patch) > 0 && string(resp.Patch) != "[]":
+		result = "patched"
+	}
+	admissionRequests.WithLabelValues(webhook, operation, namespace, result).Inc()
+}
+
+// observeImage counts an image by its registry and what happened to it. The
+// registry label is bounded by the config: images from registries that are
+// neither configured nor an alias target count as "other".
+func (s *server) observeImage(image, action string) {
+	imagesProcessed.WithLabelValues(s.registryLabel(image), action).Inc()
+}
+
+// registryLabel returns the canonical registry of image if it is configured
+// or the target of an alias, "other" for other registries and "invalid" for
+// invalid references.
+func (s *server) registryLabel(image string) string {
+	ref, err := s.parseImage(image)
+	if err != nil {
+		return "invalid"
+	}
+	if _, ok := s.prefixes[ref.Domain+"/"]; ok {
+		return ref.Domain
+	}
+	for _, canonical := range s.aliases {
+		if canonical == ref.Domain {
+			return ref.Domain
+		}
+	}
+	return "other"
+}
+
+// observeDigestLookup counts a tag to digest lookup by its result.
+func observeDigestLookup(result string) {
+	digestLookups.WithLabelValues(result).Inc()
+}
+
+// observeCertificate records a certificate load; cert is nil when it failed.
+func observeCertificate(cert *tls.Certificate) {
+	if cert == nil {
+		certReloads.WithLabelValues("error").Inc()
+		return
+	}
+	certReloads.WithLabelValues("success").Inc()
+	if cert.Leaf != nil {
+		certExpiry.Set(float64(cert.Leaf.NotAfter.Unix()))
+	}
+}
+
+// observeDuration records the time since start for webhook.
+func observeDuration(webhook string, start time.Time) {
+	requestDuration.WithLabelValues(webhook).Observe(time.Since(start).Seconds())
+}
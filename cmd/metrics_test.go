@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMetrics_Mutate(t *testing.T) {
+	srv := setupServer(t, "123456789012", "us-west-2", "docker.io")
+	patched := admissionRequests.WithLabelValues("mutate", "", "default", "patched")
+	rewritten := imagesProcessed.WithLabelValues("docker.io", "rewritten")
+	// Registries that are not configured share one series.
+	skipped := imagesProcessed.WithLabelValues("other", "skipped")
+	beforePatched, beforeRewritten, beforeSkipped := testutil.ToFloat64(patched), testutil.ToFloat64(rewritten), testutil.ToFloat64(skipped)
+
+	reviewObject(t, srv, metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "a", Image: "nginx"},
+			{Name: "b", Image: "busybox"},
+			{Name: "c", Image: "quay.io/org/app:1"},
+		}},
+	})
+
+	if got := testutil.ToFloat64(patched) - beforePatched; got != 1 {
+		t.Errorf("patched requests = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(rewritten) - beforeRewritten; got != 2 {
+		t.Errorf("rewritten docker.io images = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(skipped) - beforeSkipped; got != 1 {
+		t.Errorf("skipped other images = %v, want 1", got)
+	}
+}
+
+func TestRegistryLabel(t *testing.T) {
+	srv := setupServer(t, "123456789012", "us-west-2", "docker.io")
+	for image, want := range map[string]string{
+		"nginx":                     "docker.io",
+		"index.docker.io/nginx":     "docker.io",
+		"k8s.gcr.io/pause:3.9":      "registry.k8s.io",
+		"quay.io/org/app:1":         "other",
+		"attacker-1234.example/x:1": "other",
+		"Invalid Image":             "invalid",
+	} {
+		if got := srv.registryLabel(image); got != want {
+			t.Errorf("registryLabel(%q) = %q, want %q", image, got, want)
+		}
+	}
+}
+
+func TestMetrics_Handler(t *testing.T) {
+	srv := setupServer(t, "123456789012", "us-west-2", "docker.io")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate", srv.handleMutate)
+	mux.Handle("/metrics", promhttp.Handler())
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tooLarge := requestsTooLarge.WithLabelValues("mutate")
+	before := testutil.ToFloat64(tooLarge)
+	resp, err := http.Post(ts.URL+"/mutate", "application/json", bytes.NewReader(make([]byte, 2<<20)))
+	if err != nil {
+		t.Fatalf("post mutate: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", resp.StatusCode)
+	}
+	if got := testutil.ToFloat64(tooLarge) - before; got != 1 {
+		t.Errorf("body size rejections = %v, want 1", got)
+	}
+
+	resp, err = http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("get metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read metrics: %v", err)
+	}
+	for _, want := range []string{
+		`ecr_pull_through_request_body_too_large_total{webhook="mutate"}`,
+		`ecr_pull_through_request_duration_seconds_count{webhook="mutate"}`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics do not contain %s", want)
+		}
+	}
+}
+
+func TestMetrics_Certificate(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	notAfter := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	writeTestCertificate(t, certPath, keyPath, notAfter)
+
+	success := certReloads.WithLabelValues("success")
+	before := testutil.ToFloat64(success)
+	cr := &CertReloader{certPath: certPath, keyPath: keyPath}
+	if _, err := cr.GetCertificate(nil); err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	if got := testutil.ToFloat64(success) - before; got != 1 {
+		t.Errorf("successful reloads = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(certExpiry); got != float64(notAfter.Unix()) {
+		t.Errorf("expiry = %v, want %v", got, notAfter.Unix())
+	}
+
+	failed := certReloads.WithLabelValues("error")
+	before = testutil.ToFloat64(failed)
+	if err := os.WriteFile(keyPath, []byte("garbage"), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(certPath, later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if _, err := cr.GetCertificate(nil); err == nil {
+		t.Fatal("expected error for invalid key")
+	}
+	if got := testutil.ToFloat64(failed) - before; got != 1 {
+		t.Errorf("failed reloads = %v, want 1", got)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate expiring at notAfter.
+func writeTestCertificate(t *testing.T, certPath, keyPath string, notAfter time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientCAReloader keeps the pool of CAs trusted to sign client
+// certificates, re-reading the bundle when the file changes.
+type ClientCAReloader struct {
+	mu      sync.RWMutex
+	path    string
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+// newClientCAReloader loads the CA bundle at path.
+func newClientCAReloader(path string) (*ClientCAReloader, error) {
+	cr := &ClientCAReloader{path: path}
+	if _, err := cr.Pool(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Pool returns the current CA pool. When the file changed but cannot be
+// read, the previous pool is kept so a bad update does not lock the API
+// server out.
+func (cr *ClientCAReloader) Pool() (*x509.CertPool, error) {
+	stat, err := os.Stat(cr.path)
+	if err != nil {
+		return cr.fallback(fmt.Errorf("failed checking client CA file modification time: %w", err))
+	}
+
+	cr.mu.RLock()
+	if cr.pool != nil && !stat.ModTime().After(cr.modTime) {
+		pool := cr.pool
+		cr.mu.RUnlock()
+		return pool, nil
+	}
+	cr.mu.RUnlock()
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.pool != nil && !stat.ModTime().After(cr.modTime) {
+		return cr.pool, nil
+	}
+	bundle, err := os.ReadFile(cr.path)
+	if err != nil {
+		return cr.fallbackLocked(fmt.Errorf("failed reading client CA bundle: %w", err))
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return cr.fallbackLocked(fmt.Errorf("client CA bundle %s holds no PEM certificates", cr.path))
+	}
+	cr.pool = pool
+	cr.modTime = stat.ModTime()
+	slog.Info("client CA bundle loaded", "path", cr.path)
+	return cr.pool, nil
+}
+
+func (cr *ClientCAReloader) fallback(err error) (*x509.CertPool, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.fallbackLocked(err)
+}
+
+func (cr *ClientCAReloader) fallbackLocked(err error) (*x509.CertPool, error) {
+	if cr.pool == nil {
+		return nil, err
+	}
+	// Remember the failed version so a broken file is reported once rather
+	// than on every handshake.
+	if stat, statErr := os.Stat(cr.path); statErr == nil {
+		cr.modTime = stat.ModTime()
+	}
+	slog.Error("keeping previous client CA bundle", "error", err)
+	return cr.pool, nil
+}
+
+// withClientAuth returns a copy of base that verifies client certificates
+// against the CAs of cr. Certificates are verified when presented but not
+// required at the TLS level, so kubelet probes without one still reach
+// /health; requireClientCert enforces them on the webhook endpoints.
+func withClientAuth(base *tls.Config, cr *ClientCAReloader) *tls.Config {
+	cfg := base.Clone()
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		pool, err := cr.Pool()
+		if err != nil {
+			return nil, err
+		}
+		c := base.Clone()
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+		c.ClientCAs = pool
+		return c, nil
+	}
+	return cfg
+}
+
+// requireClientCert rejects requests without a verified client certificate.
+// When subjects is not empty, the certificate's common name or one of its
+// DNS names must also be listed.
+func requireClientCert(subjects []string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			slog.Warn("rejected request without client certificate", "path", r.URL.Path, "remote", r.RemoteAddr)
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		leaf := r.TLS.VerifiedChains[0][0]
+		if len(subjects) > 0 && !slices.Contains(subjects, leaf.Subject.CommonName) &&
+			!slices.ContainsFunc(leaf.DNSNames, func(name string) bool { return slices.Contains(subjects, name) }) {
+			slog.Warn("rejected client certificate subject", "path", r.URL.Path, "remote", r.RemoteAddr, "subject", leaf.Subject.String())
+			http.Error(w, "client certificate subject not allowed", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clientAuthFromEnv reads WEBHOOK_CLIENT_CA_FILE and WEBHOOK_CLIENT_SUBJECTS
+// (comma separated). path is empty when client authentication is disabled.
+func clientAuthFromEnv() (path string, subjects []string) {
+	for _, s := range strings.Split(os.Getenv("WEBHOOK_CLIENT_SUBJECTS"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			subjects = append(subjects, s)
+		}
+	}
+	return os.Getenv("WEBHOOK_CLIENT_CA_FILE"), subjects
+}
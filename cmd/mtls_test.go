@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a CA issuing client certificates in tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) testCA {
+	t.Helper()
+	cert, key, der, err := newCA(time.Now())
+	if err != nil {
+		t.Fatalf("newCA: %v", err)
+	}
+	return testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// clientCert issues a client certificate with the given common name and DNS
+// names.
+func (ca testCA) clientCert(t *testing.T, cn string, dnsNames ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(ca.key.Curve, rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// setupMTLSServer starts a TLS server trusting the client CAs in caPath,
+// with /health open and /mutate restricted to subjects.
+func setupMTLSServer(t *testing.T, caPath string, subjects ...string) *httptest.Server {
+	t.Helper()
+	clientCAs, err := newClientCAReloader(caPath)
+	if err != nil {
+		t.Fatalf("newClientCAReloader: %v", err)
+	}
+	ca := newTestCA(t)
+	leaf, _, keyPEM, err := newServingCert(time.Now(), []string{"webhook", "localhost"}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatalf("newServingCert: %v", err)
+	}
+	serving, err := tls.X509KeyPair(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}), keyPEM)
+	if err != nil {
+		t.Fatalf("load serving certificate: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/mutate", requireClientCert(subjects, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts := httptest.NewUnstartedServer(mux)
+	ts.TLS = withClientAuth(&tls.Config{Certificates: []tls.Certificate{serving}, MinVersion: tls.VersionTLS12}, clientCAs)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// getWithCert requests path, presenting certs as client certificates. It
+// returns the status code, or 0 when the TLS handshake fails.
+func getWithCert(t *testing.T, ts *httptest.Server, path string, certs ...tls.Certificate) int {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		Certificates:       certs,
+		InsecureSkipVerify: true,
+	}}}
+	resp, err := client.Get(ts.URL + path)
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode
+}
+
+func writeCABundle(t *testing.T, path string, bundle []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, bundle, 0o600); err != nil {
+		t.Fatalf("write CA bundle: %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	ca := newTestCA(t)
+	caPath := filepath.Join(t.TempDir(), "ca.crt")
+	writeCABundle(t, caPath, ca.pem, time.Now())
+	ts := setupMTLSServer(t, caPath, "kube-apiserver", "apiserver.example.com")
+
+	tests := []struct {
+		name  string
+		path  string
+		certs []tls.Certificate
+		want  int
+	}{
+		{name: "health without certificate", path: "/health", want: http.StatusOK},
+		{name: "mutate without certificate", path: "/mutate", want: http.StatusUnauthorized},
+		{name: "allowed common name", path: "/mutate", certs: []tls.Certificate{ca.clientCert(t, "kube-apiserver")}, want: http.StatusOK},
+		{name: "allowed DNS name", path: "/mutate", certs: []tls.Certificate{ca.clientCert(t, "other", "apiserver.example.com")}, want: http.StatusOK},
+		{name: "subject not allowed", path: "/mutate", certs: []tls.Certificate{ca.clientCert(t, "intruder")}, want: http.StatusForbidden},
+		{name: "untrusted CA", path: "/mutate", certs: []tls.Certificate{newTestCA(t).clientCert(t, "kube-apiserver")}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getWithCert(t, ts, tt.path, tt.certs...); got != tt.want {
+				t.Fatalf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientAuth_AnySubject(t *testing.T) {
+	ca := newTestCA(t)
+	caPath := filepath.Join(t.TempDir(), "ca.crt")
+	writeCABundle(t, caPath, ca.pem, time.Now())
+	ts := setupMTLSServer(t, caPath)
+
+	if got := getWithCert(t, ts, "/mutate", ca.clientCert(t, "anyone")); got != http.StatusOK {
+		t.Fatalf("status = %d, want %d", got, http.StatusOK)
+	}
+}
+
+func TestClientAuth_Reload(t *testing.T) {
+	oldCA, rotatedCA := newTestCA(t), newTestCA(t)
+	caPath := filepath.Join(t.TempDir(), "ca.crt")
+	start := time.Now().Add(-time.Minute)
+	writeCABundle(t, caPath, oldCA.pem, start)
+	ts := setupMTLSServer(t, caPath)
+
+	if got := getWithCert(t, ts, "/mutate", rotatedCA.clientCert(t, "kube-apiserver")); got != 0 {
+		t.Fatalf("status = %d before reload, want a handshake failure", got)
+	}
+
+	writeCABundle(t, caPath, rotatedCA.pem, start.Add(time.Second))
+	if got := getWithCert(t, ts, "/mutate", rotatedCA.clientCert(t, "kube-apiserver")); got != http.StatusOK {
+		t.Fatalf("status = %d after reload, want %d", got, http.StatusOK)
+	}
+	if got := getWithCert(t, ts, "/mutate", oldCA.clientCert(t, "kube-apiserver")); got != 0 {
+		t.Fatalf("status = %d for the replaced CA, want a handshake failure", got)
+	}
+
+	t.Run("invalid bundle keeps the previous CAs", func(t *testing.T) {
+		writeCABundle(t, caPath, []byte("garbage"), start.Add(2*time.Second))
+		if got := getWithCert(t, ts, "/mutate", rotatedCA.clientCert(t, "kube-apiserver")); got != http.StatusOK {
+			t.Fatalf("status = %d, want %d", got, http.StatusOK)
+		}
+	})
+}
+
+func TestNewClientCAReloader_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := newClientCAReloader(filepath.Join(dir, "missing.crt")); err == nil {
+		t.Error("expected an error for a missing bundle")
+	}
+	garbage := filepath.Join(dir, "garbage.crt")
+	writeCABundle(t, garbage, []byte("garbage"), time.Now())
+	if _, err := newClientCAReloader(garbage); err == nil {
+		t.Error("expected an error for a bundle without certificates")
+	}
+}
+
+func TestClientAuthFromEnv(t *testing.T) {
+	t.Setenv("WEBHOOK_CLIENT_CA_FILE", "/etc/webhook/client-ca/ca.crt")
+	t.Setenv("WEBHOOK_CLIENT_SUBJECTS", " kube-apiserver, ,apiserver.example.com ")
+	path, subjects := clientAuthFromEnv()
+	if path != "/etc/webhook/client-ca/ca.crt" {
+		t.Errorf("path = %q", path)
+	}
+	if len(subjects) != 2 || subjects[0] != "kube-apiserver" || subjects[1] != "apiserver.example.com" {
+		t.Errorf("subjects = %q", subjects)
+	}
+}
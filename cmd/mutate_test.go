@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 
 	v1beta1 "k8s.io/api/admission/v1beta1"
@@ -10,6 +11,8 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
+const testDigest = "sha256:dfbaa02d5fad1d1d8ee9e9c1a9a6d4c9e1b5e6b1f0e4f9a8c3d2b1a0f9e8d7c6"
+
 func setupServer(t *testing.T, accountID, region, registries string) *server {
 	t.Helper()
 	t.Setenv("ECR_AWS_ACCOUNT_ID", accountID)
@@ -23,7 +26,7 @@ func setupServer(t *testing.T, accountID, region, registries string) *server {
 }
 
 func TestMutate(t *testing.T) {
-	srv := setupServer(t, "12345", "us-west-2", "ghcr.io,docker.io")
+	srv := setupServer(t, "123456789012", "us-west-2", "ghcr.io,docker.io")
 
 	t.Run("containers", func(t *testing.T) {
 		pod := &corev1.Pod{
@@ -36,8 +39,8 @@ func TestMutate(t *testing.T) {
 			},
 		}
 		checkMutatePatch(t, srv, pod, map[string]string{
-			"/spec/containers/0/image": "12345.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx",
-			"/spec/containers/1/image": "12345.dkr.ecr.us-west-2.amazonaws.com/ghcr.io/owner/image:tag",
+			"/spec/containers/0/image": "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx",
+			"/spec/containers/1/image": "123456789012.dkr.ecr.us-west-2.amazonaws.com/ghcr.io/owner/image:tag",
 		})
 	})
 
@@ -51,49 +54,49 @@ func TestMutate(t *testing.T) {
 			},
 		}
 		checkMutatePatch(t, srv, pod, map[string]string{
-			"/spec/initContainers/0/image": "12345.dkr.ecr.us-west-2.amazonaws.com/docker.io/owner/init:1.0",
+			"/spec/initContainers/0/image": "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/owner/init:1.0",
 		})
 	})
 
 	t.Run("cross-region ECR rewrite", func(t *testing.T) {
-		srv := setupServer(t, "12345", "us-east-1", "12345.dkr.ecr.eu-west-1.amazonaws.com")
+		srv := setupServer(t, "123456789012", "us-east-1", "123456789012.dkr.ecr.eu-west-1.amazonaws.com")
 		pod := &corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
 			Spec: corev1.PodSpec{
 				Containers: []corev1.Container{
-					{Name: "app-prefixed", Image: "12345.dkr.ecr.eu-west-1.amazonaws.com/prefix/image:tag"},
-					{Name: "app-plain", Image: "12345.dkr.ecr.eu-west-1.amazonaws.com/imagewithoutprefix:tag"},
+					{Name: "app-prefixed", Image: "123456789012.dkr.ecr.eu-west-1.amazonaws.com/prefix/image:tag"},
+					{Name: "app-plain", Image: "123456789012.dkr.ecr.eu-west-1.amazonaws.com/imagewithoutprefix:tag"},
 				},
 			},
 		}
 		checkMutatePatch(t, srv, pod, map[string]string{
-			"/spec/containers/0/image": "12345.dkr.ecr.us-east-1.amazonaws.com/prefix/image:tag",
-			"/spec/containers/1/image": "12345.dkr.ecr.us-east-1.amazonaws.com/imagewithoutprefix:tag",
+			"/spec/containers/0/image": "123456789012.dkr.ecr.us-east-1.amazonaws.com/prefix/image:tag",
+			"/spec/containers/1/image": "123456789012.dkr.ecr.us-east-1.amazonaws.com/imagewithoutprefix:tag",
 		})
 	})
 
 	t.Run("cross-account ECR rewrite", func(t *testing.T) {
-		srv := setupServer(t, "12345", "us-east-1", "99999.dkr.ecr.eu-west-1.amazonaws.com")
+		srv := setupServer(t, "123456789012", "us-east-1", "999999999999.dkr.ecr.eu-west-1.amazonaws.com")
 		pod := &corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
 			Spec: corev1.PodSpec{
 				Containers: []corev1.Container{
-					{Name: "app", Image: "99999.dkr.ecr.eu-west-1.amazonaws.com/org/image:tag"},
+					{Name: "app", Image: "999999999999.dkr.ecr.eu-west-1.amazonaws.com/org/image:tag"},
 				},
 			},
 		}
 		checkMutatePatch(t, srv, pod, map[string]string{
-			"/spec/containers/0/image": "12345.dkr.ecr.us-east-1.amazonaws.com/org/image:tag",
+			"/spec/containers/0/image": "123456789012.dkr.ecr.us-east-1.amazonaws.com/org/image:tag",
 		})
 	})
 
 	t.Run("same-region ECR image not patched", func(t *testing.T) {
-		srv := setupServer(t, "12345", "us-east-1", "12345.dkr.ecr.eu-west-1.amazonaws.com")
+		srv := setupServer(t, "123456789012", "us-east-1", "123456789012.dkr.ecr.eu-west-1.amazonaws.com")
 		pod := &corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
 			Spec: corev1.PodSpec{
 				Containers: []corev1.Container{
-					{Name: "app", Image: "12345.dkr.ecr.us-east-1.amazonaws.com/msp/comments:us-32"},
+					{Name: "app", Image: "123456789012.dkr.ecr.us-east-1.amazonaws.com/msp/comments:us-32"},
 				},
 			},
 		}
@@ -101,12 +104,12 @@ func TestMutate(t *testing.T) {
 	})
 
 	t.Run("third-party ECR account not rewritten", func(t *testing.T) {
-		srv := setupServer(t, "12345", "us-east-1", "12345.dkr.ecr.eu-west-1.amazonaws.com")
+		srv := setupServer(t, "123456789012", "us-east-1", "123456789012.dkr.ecr.eu-west-1.amazonaws.com")
 		pod := &corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
 			Spec: corev1.PodSpec{
 				Containers: []corev1.Container{
-					{Name: "app", Image: "99999.dkr.ecr.eu-west-1.amazonaws.com/org/image:tag"},
+					{Name: "app", Image: "999999999999.dkr.ecr.eu-west-1.amazonaws.com/org/image:tag"},
 				},
 			},
 		}
@@ -114,7 +117,7 @@ func TestMutate(t *testing.T) {
 	})
 
 	t.Run("docker.io images get library normalised", func(t *testing.T) {
-		srv := setupServer(t, "12345", "us-west-2", "docker.io")
+		srv := setupServer(t, "123456789012", "us-west-2", "docker.io")
 		pod := &corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
 			Spec: corev1.PodSpec{
@@ -126,19 +129,19 @@ func TestMutate(t *testing.T) {
 			},
 		}
 		checkMutatePatch(t, srv, pod, map[string]string{
-			"/spec/containers/0/image": "12345.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx",
-			"/spec/containers/1/image": "12345.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx",
-			"/spec/containers/2/image": "12345.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx",
+			"/spec/containers/0/image": "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx",
+			"/spec/containers/1/image": "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx",
+			"/spec/containers/2/image": "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx",
 		})
 	})
 
 	t.Run("image already at ecrRegistryHostname is not re-prefixed", func(t *testing.T) {
-		srv := setupServer(t, "12345", "us-east-1", "12345.dkr.ecr.us-east-1.amazonaws.com")
+		srv := setupServer(t, "123456789012", "us-east-1", "123456789012.dkr.ecr.us-east-1.amazonaws.com")
 		pod := &corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
 			Spec: corev1.PodSpec{
 				Containers: []corev1.Container{
-					{Name: "app", Image: "12345.dkr.ecr.us-east-1.amazonaws.com/myrepo/myimage:latest"},
+					{Name: "app", Image: "123456789012.dkr.ecr.us-east-1.amazonaws.com/myrepo/myimage:latest"},
 				},
 			},
 		}
@@ -159,7 +162,7 @@ func TestMutate(t *testing.T) {
 }
 
 func TestRewriteImage(t *testing.T) {
-	srv := setupServer(t, "12345", "us-west-2", "ghcr.io,docker.io,public.ecr.aws")
+	srv := setupServer(t, "123456789012", "us-west-2", "ghcr.io,docker.io,public.ecr.aws")
 
 	tests := []struct {
 		name  string
@@ -168,28 +171,33 @@ func TestRewriteImage(t *testing.T) {
 		ok    bool
 	}{
 		// Docker Hub normalization
-		{"bare image", "nginx", "12345.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx", true},
-		{"bare image with tag", "nginx:1.25", "12345.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx:1.25", true},
-		{"implicit docker hub", "owner/image", "12345.dkr.ecr.us-west-2.amazonaws.com/docker.io/owner/image", true},
-		{"explicit docker.io short", "docker.io/nginx", "12345.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx", true},
-		{"explicit docker.io with library", "docker.io/library/nginx", "12345.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx", true},
-		{"explicit docker.io with owner", "docker.io/owner/image:1.2", "12345.dkr.ecr.us-west-2.amazonaws.com/docker.io/owner/image:1.2", true},
-		{"docker.io with digest", "docker.io/nginx@sha256:abc", "12345.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx@sha256:abc", true},
-		{"implicit docker hub nested", "a/b/c:tag", "12345.dkr.ecr.us-west-2.amazonaws.com/docker.io/a/b/c:tag", true},
+		{"bare image", "nginx", "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx", true},
+		{"bare image with tag", "nginx:1.25", "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx:1.25", true},
+		{"implicit docker hub", "owner/image", "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/owner/image", true},
+		{"explicit docker.io short", "docker.io/nginx", "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx", true},
+		{"explicit docker.io with library", "docker.io/library/nginx", "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx", true},
+		{"explicit docker.io with owner", "docker.io/owner/image:1.2", "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/owner/image:1.2", true},
+		{"docker.io with digest", "docker.io/nginx@" + testDigest, "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx@" + testDigest, true},
+		{"implicit docker hub nested", "a/b/c:tag", "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/a/b/c:tag", true},
 
 		// Other configured registries
-		{"ghcr.io image", "ghcr.io/owner/image:tag", "12345.dkr.ecr.us-west-2.amazonaws.com/ghcr.io/owner/image:tag", true},
-		{"public.ecr.aws image", "public.ecr.aws/karpenter/controller:1.8.6", "12345.dkr.ecr.us-west-2.amazonaws.com/public.ecr.aws/karpenter/controller:1.8.6", true},
-		{"public.ecr.aws with digest", "public.ecr.aws/karpenter/controller:1.8.6@sha256:dfbaa02d5fad", "12345.dkr.ecr.us-west-2.amazonaws.com/public.ecr.aws/karpenter/controller:1.8.6@sha256:dfbaa02d5fad", true},
+		{"ghcr.io image", "ghcr.io/owner/image:tag", "123456789012.dkr.ecr.us-west-2.amazonaws.com/ghcr.io/owner/image:tag", true},
+		{"public.ecr.aws image", "public.ecr.aws/karpenter/controller:1.8.6", "123456789012.dkr.ecr.us-west-2.amazonaws.com/public.ecr.aws/karpenter/controller:1.8.6", true},
+		{"public.ecr.aws with digest", "public.ecr.aws/karpenter/controller:1.8.6@" + testDigest, "123456789012.dkr.ecr.us-west-2.amazonaws.com/public.ecr.aws/karpenter/controller:1.8.6@" + testDigest, true},
 
 		// Unconfigured registry
 		{"quay.io not configured", "quay.io/org/repo:tag", "", false},
 		{"random registry", "registry.example.com/org/image:tag", "", false},
+		{"localhost is a registry", "localhost/foo", "", false},
+		{"registry with port and digest", "registry:5000/foo@" + testDigest, "", false},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, ok := srv.rewriteImage(tt.image)
+			got, ok, err := srv.rewriteImage(tt.image)
+			if err != nil {
+				t.Fatalf("rewriteImage(%q) unexpected error: %v", tt.image, err)
+			}
 			if ok != tt.ok {
 				t.Fatalf("rewriteImage(%q) ok = %v, want %v", tt.image, ok, tt.ok)
 			}
@@ -201,7 +209,7 @@ func TestRewriteImage(t *testing.T) {
 }
 
 func TestRewriteImage_ECR(t *testing.T) {
-	srv := setupServer(t, "12345", "us-east-1", "99999.dkr.ecr.eu-west-1.amazonaws.com")
+	srv := setupServer(t, "123456789012", "us-east-1", "999999999999.dkr.ecr.eu-west-1.amazonaws.com")
 
 	tests := []struct {
 		name  string
@@ -209,13 +217,16 @@ func TestRewriteImage_ECR(t *testing.T) {
 		want  string
 		ok    bool
 	}{
-		{"cross-account rewrite", "99999.dkr.ecr.eu-west-1.amazonaws.com/org/image:tag", "12345.dkr.ecr.us-east-1.amazonaws.com/org/image:tag", true},
-		{"different ECR not configured", "88888.dkr.ecr.eu-west-1.amazonaws.com/image:tag", "", false},
+		{"cross-account rewrite", "999999999999.dkr.ecr.eu-west-1.amazonaws.com/org/image:tag", "123456789012.dkr.ecr.us-east-1.amazonaws.com/org/image:tag", true},
+		{"different ECR not configured", "888888888888.dkr.ecr.eu-west-1.amazonaws.com/image:tag", "", false},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, ok := srv.rewriteImage(tt.image)
+			got, ok, err := srv.rewriteImage(tt.image)
+			if err != nil {
+				t.Fatalf("rewriteImage(%q) unexpected error: %v", tt.image, err)
+			}
 			if ok != tt.ok {
 				t.Fatalf("rewriteImage(%q) ok = %v, want %v", tt.image, ok, tt.ok)
 			}
@@ -226,7 +237,118 @@ func TestRewriteImage_ECR(t *testing.T) {
 	}
 }
 
-func checkMutatePatch(t *testing.T, srv *server, pod *corev1.Pod, want map[string]string) {
+func TestRewriteImage_Prefixes(t *testing.T) {
+	srv := setupServer(t, "123456789012", "us-west-2", "docker.io=dockerhub,registry.k8s.io=k8s,ghcr.io,999999999999.dkr.ecr.eu-west-1.amazonaws.com=mirror/eu")
+
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"nginx:1.27", "123456789012.dkr.ecr.us-west-2.amazonaws.com/dockerhub/library/nginx:1.27"},
+		{"owner/app", "123456789012.dkr.ecr.us-west-2.amazonaws.com/dockerhub/owner/app"},
+		{"registry.k8s.io/pause:3.10", "123456789012.dkr.ecr.us-west-2.amazonaws.com/k8s/pause:3.10"},
+		{"ghcr.io/owner/app", "123456789012.dkr.ecr.us-west-2.amazonaws.com/ghcr.io/owner/app"},
+		{"999999999999.dkr.ecr.eu-west-1.amazonaws.com/org/app:v1", "123456789012.dkr.ecr.us-west-2.amazonaws.com/mirror/eu/org/app:v1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			got, ok, err := srv.rewriteImage(tt.image)
+			if err != nil || !ok {
+				t.Fatalf("rewriteImage(%q) = %q, %v, %v", tt.image, got, ok, err)
+			}
+			if got != tt.want {
+				t.Fatalf("rewriteImage(%q) = %q, want %q", tt.image, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteImage_Invalid(t *testing.T) {
+	srv := setupServer(t, "123456789012", "us-west-2", "docker.io")
+
+	for _, image := range []string{"Nginx", "docker.io/Owner/app", "nginx:", "nginx@sha256:abc", "ghcr.io//app", "nginx:-bad"} {
+		t.Run(image, func(t *testing.T) {
+			got, ok, err := srv.rewriteImage(image)
+			if err == nil {
+				t.Fatalf("rewriteImage(%q) = %q, %v; want error", image, got, ok)
+			}
+		})
+	}
+}
+
+func TestMutate_InvalidImageDenied(t *testing.T) {
+	srv := setupServer(t, "123456789012", "us-west-2", "docker.io")
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "ok", Image: "nginx"},
+				{Name: "broken", Image: "Nginx:latest"},
+			},
+		},
+	}
+	out := reviewPod(t, srv, pod)
+	if out.Response.Allowed {
+		t.Fatal("expected pod with invalid image to be denied")
+	}
+	if out.Response.Result == nil || !strings.Contains(out.Response.Result.Message, `container "broken"`) {
+		t.Fatalf("denial message does not name the container: %+v", out.Response.Result)
+	}
+	if len(out.Response.Patch) != 0 {
+		t.Fatalf("expected no patch, got %s", out.Response.Patch)
+	}
+}
+
+func TestMutate_ReviewVersions(t *testing.T) {
+	srv := setupServer(t, "123456789012", "us-west-2", "docker.io")
+	podJSON, err := json.Marshal(&corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}}})
+	if err != nil {
+		t.Fatalf("marshal pod: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name        string
+		requestVer  string
+		responseVer string
+	}{
+		{"v1", "admission.k8s.io/v1", "admission.k8s.io/v1"},
+		{"v1beta1", "admission.k8s.io/v1beta1", "admission.k8s.io/v1beta1"},
+		{"unset defaults to v1", "", "admission.k8s.io/v1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(map[string]any{
+				"apiVersion": tt.requestVer,
+				"kind":       "AdmissionReview",
+				"request":    map[string]any{"uid": "u1", "object": json.RawMessage(podJSON)},
+			})
+			if err != nil {
+				t.Fatalf("marshal review: %v", err)
+			}
+			mutated, err := srv.mutate(body)
+			if err != nil {
+				t.Fatalf("mutate error: %v", err)
+			}
+			var out metav1.TypeMeta
+			if err := json.Unmarshal(mutated, &out); err != nil {
+				t.Fatalf("unmarshal response: %v", err)
+			}
+			if out.APIVersion != tt.responseVer || out.Kind != "AdmissionReview" {
+				t.Fatalf("response type = %s %s, want %s AdmissionReview", out.APIVersion, out.Kind, tt.responseVer)
+			}
+		})
+	}
+
+	t.Run("unsupported version", func(t *testing.T) {
+		body := []byte(`{"apiVersion":"admission.k8s.io/v2","kind":"AdmissionReview","request":{"uid":"u1"}}`)
+		if _, err := srv.mutate(body); err == nil {
+			t.Fatal("expected error for unsupported version")
+		}
+	})
+}
+
+// reviewPod sends pod through mutate and returns the decoded AdmissionReview.
+func reviewPod(t *testing.T, srv *server, pod *corev1.Pod) v1beta1.AdmissionReview {
 	t.Helper()
 	podJSON, err := json.Marshal(pod)
 	if err != nil {
@@ -252,16 +374,12 @@ func checkMutatePatch(t *testing.T, srv *server, pod *corev1.Pod, want map[strin
 	if out.Response == nil {
 		t.Fatalf("response is nil")
 	}
-	var patches []map[string]string
-	if err := json.Unmarshal(out.Response.Patch, &patches); err != nil {
-		t.Fatalf("unmarshal patch: %v", err)
-	}
-	got := map[string]string{}
-	for _, p := range patches {
-		if path, ok := p["path"]; ok {
-			got[path] = p["value"]
-		}
-	}
+	return out
+}
+
+func checkMutatePatch(t *testing.T, srv *server, pod *corev1.Pod, want map[string]string) {
+	t.Helper()
+	got := imagePatches(t, reviewPod(t, srv, pod))
 	for k, v := range want {
 		if gotV, ok := got[k]; !ok {
 			t.Errorf("missing patch for %s", k)
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"reflect"
+)
+
+// originalImagesAnnotation records, on the pod or pod template, the upstream
+// image of every container the webhook rewrote as a JSON object keyed by
+// container name.
+const originalImagesAnnotation = "ecr-pull-through/original-images"
+
+// originalImages returns the annotation value the workload should carry
+// after rewrites are applied, and the value it carries now. Containers that
+// were rewritten on an earlier admission keep their recorded original as
+// long as their image is still the rewrite of it, so admitting an
+// already-mutated object (e.g. a pod created from a mutated template) leaves
+// the annotation unchanged. Containers whose image an UPDATE did not change,
+// per previous, keep their recorded original as is.
+func (s *server) originalImages(w *workload, fields []imageField, previous map[string]string, rewrites []imageRewrite, target ecrTarget) (originals, recorded map[string]string) {
+	recorded = map[string]string{}
+	if v, ok := w.podMeta.Annotations[originalImagesAnnotation]; ok {
+		if err := json.Unmarshal([]byte(v), &recorded); err != nil {
+			slog.Warn("ignoring invalid annotation", "annotation", originalImagesAnnotation, "error", err)
+			recorded = map[string]string{}
+		}
+	}
+
+	originals = map[string]string{}
+	for _, rw := range rewrites {
+		originals[rw.Container] = rw.Original
+	}
+	for _, f := range fields {
+		if _, ok := originals[f.container]; ok {
+			continue
+		}
+		original, ok := recorded[f.container]
+		if !ok {
+			continue
+		}
+		if old, ok := previous[f.path]; ok && old == f.image {
+			originals[f.container] = original
+			continue
+		}
+		if d, err := s.evaluateImageAt(original, target); err == nil && d.Action == actionRewrite && (d.Image == f.image || isPinnedRewrite(f.image, d.Image)) {
+			originals[f.container] = original
+		}
+	}
+	return originals, recorded
+}
+
+// originalImagesPatch returns the patch operation that brings the annotation
+// from recorded to originals, or nil when it is already up to date.
+func originalImagesPatch(w *workload, originals, recorded map[string]string) (*patchOperation, error) {
+	_, annotated := w.podMeta.Annotations[originalImagesAnnotation]
+	path := w.podMetaPath + "/annotations/" + escapePointerSegment(originalImagesAnnotation)
+	if len(originals) == 0 {
+		if annotated {
+			return &patchOperation{Op: "remove", Path: path}, nil
+		}
+		return nil, nil
+	}
+	if annotated && maps.Equal(originals, recorded) {
+		return nil, nil
+	}
+
+	v, err := json.Marshal(originals)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s annotation: %w", originalImagesAnnotation, err)
+	}
+	value := string(v)
+	switch {
+	case w.podMeta.Annotations != nil:
+		return &patchOperation{Op: "add", Path: path, Value: value}, nil
+	case reflect.ValueOf(*w.podMeta).IsZero():
+		// Pod templates may omit metadata altogether.
+		return &patchOperation{Op: "add", Path: w.podMetaPath, Value: map[string]any{
+			"annotations": map[string]string{originalImagesAnnotation: value},
+		}}, nil
+	default:
+		return &patchOperation{Op: "add", Path: w.podMetaPath + "/annotations", Value: map[string]string{originalImagesAnnotation: value}}, nil
+	}
+}
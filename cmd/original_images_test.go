@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"strings"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// annotationPatch returns the patch operation touching the pod metadata.
+func annotationPatch(t *testing.T, patches []patchOperation) (patchOperation, bool) {
+	t.Helper()
+	var found []patchOperation
+	for _, p := range patches {
+		if strings.Contains(p.Path, "/metadata") {
+			found = append(found, p)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return patchOperation{}, false
+	case 1:
+		return found[0], true
+	}
+	t.Fatalf("expected at most one metadata patch, got %v", found)
+	return patchOperation{}, false
+}
+
+// decodeOriginals decodes an original-images annotation value.
+func decodeOriginals(t *testing.T, v any) map[string]string {
+	t.Helper()
+	s, ok := v.(string)
+	if !ok {
+		t.Fatalf("annotation value %v is not a string", v)
+	}
+	var originals map[string]string
+	if err := json.Unmarshal([]byte(s), &originals); err != nil {
+		t.Fatalf("unmarshal annotation: %v", err)
+	}
+	return originals
+}
+
+func TestMutate_OriginalImagesAnnotation(t *testing.T) {
+	srv := setupServer(t, "123456789012", "us-west-2", "docker.io")
+	const ecr = "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/"
+	spec := corev1.PodSpec{
+		InitContainers:      []corev1.Container{{Name: "init", Image: "busybox"}},
+		Containers:          []corev1.Container{{Name: "app", Image: "nginx:1.27"}, {Name: "sidecar", Image: "ghcr.io/org/proxy:1"}},
+		EphemeralContainers: []corev1.EphemeralContainer{{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Image: "alpine"}}},
+	}
+	wantOriginals := map[string]string{"app": "nginx:1.27", "init": "busybox", "debug": "alpine"}
+
+	t.Run("pod without annotations", func(t *testing.T) {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default"}, Spec: spec}
+		op, ok := annotationPatch(t, decodePatch(t, reviewPod(t, srv, pod)))
+		if !ok {
+			t.Fatal("missing annotation patch")
+		}
+		if op.Op != "add" || op.Path != "/metadata/annotations" {
+			t.Fatalf("patch = %+v, want add /metadata/annotations", op)
+		}
+		annotations, ok := op.Value.(map[string]any)
+		if !ok {
+			t.Fatalf("value %v is not an object", op.Value)
+		}
+		if got := decodeOriginals(t, annotations[originalImagesAnnotation]); !maps.Equal(got, wantOriginals) {
+			t.Fatalf("originals = %v, want %v", got, wantOriginals)
+		}
+	})
+
+	t.Run("pod with other annotations", func(t *testing.T) {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", Annotations: map[string]string{"team": "a"}}, Spec: spec}
+		op, ok := annotationPatch(t, decodePatch(t, reviewPod(t, srv, pod)))
+		if !ok {
+			t.Fatal("missing annotation patch")
+		}
+		if want := "/metadata/annotations/ecr-pull-through~1original-images"; op.Op != "add" || op.Path != want {
+			t.Fatalf("patch = %+v, want add %s", op, want)
+		}
+		if got := decodeOriginals(t, op.Value); !maps.Equal(got, wantOriginals) {
+			t.Fatalf("originals = %v, want %v", got, wantOriginals)
+		}
+	})
+
+	t.Run("already mutated pod is left alone", func(t *testing.T) {
+		mutated := spec.DeepCopy()
+		mutated.InitContainers[0].Image = ecr + "busybox"
+		mutated.Containers[0].Image = ecr + "nginx:1.27"
+		mutated.EphemeralContainers[0].Image = ecr + "alpine"
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", Annotations: map[string]string{
+				originalImagesAnnotation: `{"app":"nginx:1.27","debug":"alpine","init":"busybox"}`,
+			}},
+			Spec: *mutated,
+		}
+		if patches := decodePatch(t, reviewPod(t, srv, pod)); len(patches) != 0 {
+			t.Fatalf("expected no patches, got %+v", patches)
+		}
+	})
+
+	t.Run("changed image updates the annotation", func(t *testing.T) {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", Annotations: map[string]string{
+				originalImagesAnnotation: `{"app":"nginx:1.26"}`,
+			}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx:1.27"}}},
+		}
+		op, ok := annotationPatch(t, decodePatch(t, reviewPod(t, srv, pod)))
+		if !ok {
+			t.Fatal("missing annotation patch")
+		}
+		if got, want := decodeOriginals(t, op.Value), map[string]string{"app": "nginx:1.27"}; !maps.Equal(got, want) {
+			t.Fatalf("originals = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("stale annotation is removed", func(t *testing.T) {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", Annotations: map[string]string{
+				originalImagesAnnotation: `{"app":"nginx:1.27"}`,
+			}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "ghcr.io/org/app:2"}}},
+		}
+		op, ok := annotationPatch(t, decodePatch(t, reviewPod(t, srv, pod)))
+		if want := "/metadata/annotations/ecr-pull-through~1original-images"; !ok || op.Op != "remove" || op.Path != want {
+			t.Fatalf("patch = %+v, want remove %s", op, want)
+		}
+	})
+
+	t.Run("invalid annotation is overwritten", func(t *testing.T) {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", Annotations: map[string]string{
+				originalImagesAnnotation: "not json",
+			}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx:1.27"}}},
+		}
+		op, ok := annotationPatch(t, decodePatch(t, reviewPod(t, srv, pod)))
+		if !ok {
+			t.Fatal("missing annotation patch")
+		}
+		if got, want := decodeOriginals(t, op.Value), map[string]string{"app": "nginx:1.27"}; !maps.Equal(got, want) {
+			t.Fatalf("originals = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("pod template without metadata", func(t *testing.T) {
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "j", Namespace: "default"},
+			Spec:       batchv1.JobSpec{Template: corev1.PodTemplateSpec{Spec: spec}},
+		}
+		out := reviewObject(t, srv, metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}, job)
+		op, ok := annotationPatch(t, decodePatch(t, out))
+		if !ok || op.Op != "add" || op.Path != "/spec/template/metadata" {
+			t.Fatalf("patch = %+v, want add /spec/template/metadata", op)
+		}
+		meta, _ := op.Value.(map[string]any)
+		annotations, _ := meta["annotations"].(map[string]any)
+		if got := decodeOriginals(t, annotations[originalImagesAnnotation]); !maps.Equal(got, wantOriginals) {
+			t.Fatalf("originals = %v, want %v", got, wantOriginals)
+		}
+	})
+
+	t.Run("pod template with labels", func(t *testing.T) {
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "j", Namespace: "default"},
+			Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "j"}},
+				Spec:       spec,
+			}},
+		}
+		out := reviewObject(t, srv, metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}, job)
+		op, ok := annotationPatch(t, decodePatch(t, out))
+		if !ok || op.Op != "add" || op.Path != "/spec/template/metadata/annotations" {
+			t.Fatalf("patch = %+v, want add /spec/template/metadata/annotations", op)
+		}
+	})
+
+	t.Run("no rewrites, no annotation", func(t *testing.T) {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default"},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "ghcr.io/org/app:2"}}},
+		}
+		if _, ok := annotationPatch(t, decodePatch(t, reviewPod(t, srv, pod))); ok {
+			t.Fatal("unexpected annotation patch")
+		}
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Grammar of image references as defined by the OCI distribution spec and
+// implemented by github.com/distribution/reference:
+//
+//	reference        := name [ ":" tag ] [ "@" digest ]
+//	name             := [domain '/'] path
+//	domain           := host [':' port-number]
+//	host             := domain-name | IPv4address | \[ IPv6address \]
+//	path             := path-component ['/' path-component]*
+//	path-component   := alpha-numeric [separator alpha-numeric]*
+//	alpha-numeric    := /[a-z0-9]+/
+//	separator        := /[_.]|__|[-]+/
+//	tag              := /[\w][\w.-]{0,127}/
+//	digest           := algorithm ":" encoded
+//	algorithm        := /[a-z0-9]+([+._-][a-z0-9]+)*/
+//	encoded          := /[a-fA-F0-9]{32,}/
+const maxNameLength = 255
+
+const (
+	domainExpr        = `(?:(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*|\[(?:[a-fA-F0-9:]+)\])(?::[0-9]+)?`
+	pathComponentExpr = `[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*`
+	tagExpr           = `[\w][\w.-]{0,127}`
+	digestExpr        = `[a-z0-9]+(?:[+._-][a-z0-9]+)*:[a-fA-F0-9]{32,}`
+)
+
+var (
+	domainPattern        = regexp.MustCompile(`^` + domainExpr + `$`)
+	pathComponentPattern = regexp.MustCompile(`^` + pathComponentExpr + `$`)
+	tagPattern           = regexp.MustCompile(`^` + tagExpr + `$`)
+	digestPattern        = regexp.MustCompile(`^` + digestExpr + `$`)
+
+	// referencePattern matches the references parseReference accepts, except
+	// that it does not check the name length or the encoded length of
+	// registered digest algorithms. It is meant for generated policies, which
+	// cannot call parseReference.
+	referencePattern = regexp.MustCompile(`^(?:` + domainExpr + `/)?` + pathComponentExpr + `(?:/` + pathComponentExpr + `)*(?::` + tagExpr + `)?(?:@` + digestExpr + `)?$`)
+
+	// digestLengths holds the encoded length of the registered digest algorithms.
+	digestLengths = map[string]int{"sha256": 64, "sha384": 96, "sha512": 128}
+)
+
+var (
+	errNameEmpty             = errors.New("repository name must have at least one component")
+	errNameTooLong           = fmt.Errorf("repository name must not be more than %d characters", maxNameLength)
+	errNameContainsUppercase = errors.New("repository name must be lowercase")
+	errInvalidDomain         = errors.New("invalid registry domain")
+	errInvalidPath           = errors.New("invalid repository path")
+	errInvalidTag            = errors.New("invalid tag format")
+	errInvalidDigest         = errors.New("invalid digest format")
+)
+
+// reference is a parsed image reference, normalized the way container
+// runtimes resolve it: references without a registry belong to docker.io and
+// single-component Docker Hub paths live under library/.
+type reference struct {
+	Domain string // registry host with optional port, e.g. "docker.io" or "localhost:5000"
+	Path   string // repository path, e.g. "library/nginx"
+	Tag    string // optional, without the leading ':'
+	Digest string // optional, e.g. "sha256:..."
+}
+
+// parseReference parses and normalizes an image reference. Unlike
+// normalization in the container runtime it never adds an implicit ":latest"
+// tag, so a rewritten reference keeps the original's tag and digest as written.
+func parseReference(s string) (reference, error) {
+	fail := func(err error) (reference, error) {
+		return reference{}, fmt.Errorf("invalid image reference %q: %w", s, err)
+	}
+
+	var ref reference
+	name := s
+	if i := strings.IndexByte(name, '@'); i >= 0 {
+		ref.Digest = name[i+1:]
+		name = name[:i]
+		if !validDigest(ref.Digest) {
+			return fail(errInvalidDigest)
+		}
+	}
+	if i := strings.LastIndexByte(name, ':'); i > strings.LastIndexByte(name, '/') {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+		if !tagPattern.MatchString(ref.Tag) {
+			return fail(errInvalidTag)
+		}
+	}
+
+	if name == "" {
+		return fail(errNameEmpty)
+	}
+	if len(name) > maxNameLength {
+		return fail(errNameTooLong)
+	}
+
+	ref.Domain, ref.Path = splitDomain(name)
+	if !domainPattern.MatchString(ref.Domain) {
+		return fail(errInvalidDomain)
+	}
+	for component := range strings.SplitSeq(ref.Path, "/") {
+		if pathComponentPattern.MatchString(component) {
+			continue
+		}
+		if pathComponentPattern.MatchString(strings.ToLower(component)) {
+			return fail(errNameContainsUppercase)
+		}
+		return fail(errInvalidPath)
+	}
+	return ref, nil
+}
+
+// splitDomain separates the registry from the repository path. The first
+// component is a registry only if it looks like a host: it contains a '.' or
+// ':', is "localhost", or has uppercase letters (which a path may not).
+func splitDomain(name string) (domain, path string) {
+	i := strings.IndexByte(name, '/')
+	if i == -1 || (!strings.ContainsAny(name[:i], ".:") && name[:i] != "localhost" && strings.ToLower(name[:i]) == name[:i]) {
+		domain, path = strings.TrimSuffix(dockerHubRegistry, "/"), name
+	} else {
+		domain, path = name[:i], name[i+1:]
+	}
+	if domain+"/" == dockerHubRegistry && !strings.ContainsRune(path, '/') {
+		path = "library/" + path
+	}
+	return domain, path
+}
+
+func validDigest(d string) bool {
+	if !digestPattern.MatchString(d) {
+		return false
+	}
+	algorithm, encoded, _ := strings.Cut(d, ":")
+	if n, ok := digestLengths[algorithm]; ok && len(encoded) != n {
+		return false
+	}
+	return true
+}
+
+// Name returns the fully qualified repository name, e.g. "docker.io/library/nginx".
+func (r reference) Name() string {
+	return r.Domain + "/" + r.Path
+}
+
+// Suffix returns the ":tag" and "@digest" parts as written.
+func (r reference) Suffix() string {
+	var b strings.Builder
+	if r.Tag != "" {
+		b.WriteString(":" + r.Tag)
+	}
+	if r.Digest != "" {
+		b.WriteString("@" + r.Digest)
+	}
+	return b.String()
+}
+
+func (r reference) String() string {
+	return r.Name() + r.Suffix()
+}
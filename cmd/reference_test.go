@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		input string
+		want  reference
+	}{
+		{"nginx", reference{Domain: "docker.io", Path: "library/nginx"}},
+		{"nginx:1.27", reference{Domain: "docker.io", Path: "library/nginx", Tag: "1.27"}},
+		{"owner/app", reference{Domain: "docker.io", Path: "owner/app"}},
+		{"docker.io/nginx", reference{Domain: "docker.io", Path: "library/nginx"}},
+		{"localhost/foo", reference{Domain: "localhost", Path: "foo"}},
+		{"localhost:5000/foo:bar", reference{Domain: "localhost:5000", Path: "foo", Tag: "bar"}},
+		{"registry:5000/foo@" + testDigest, reference{Domain: "registry:5000", Path: "foo", Digest: testDigest}},
+		{"ghcr.io/a/b/c:v1@" + testDigest, reference{Domain: "ghcr.io", Path: "a/b/c", Tag: "v1", Digest: testDigest}},
+		{"[::1]:5000/foo", reference{Domain: "[::1]:5000", Path: "foo"}},
+		{"Registry.Example.com/foo", reference{Domain: "Registry.Example.com", Path: "foo"}},
+		{"quay.io/a__b/c-d.e", reference{Domain: "quay.io", Path: "a__b/c-d.e"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseReference(tt.input)
+			if err != nil {
+				t.Fatalf("parseReference(%q) unexpected error: %v", tt.input, err)
+			}
+			if got != tt.want {
+				t.Fatalf("parseReference(%q) = %+v, want %+v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseReference_Errors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  error
+	}{
+		{"", errNameEmpty},
+		{":tag", errNameEmpty},
+		{"Uppercase", errNameContainsUppercase},
+		{"docker.io/Owner/app", errNameContainsUppercase},
+		{"ghcr.io//app", errInvalidPath},
+		{"ghcr.io/app-", errInvalidPath},
+		{"-bad.io/app", errInvalidDomain},
+		{"nginx:", errInvalidTag},
+		{"nginx:-x", errInvalidTag},
+		{"nginx@sha256:abc", errInvalidDigest},
+		{"nginx@sha256:" + testDigest[7:] + "00", errInvalidDigest},
+		{"nginx@" + testDigest + "@" + testDigest, errInvalidDigest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := parseReference(tt.input)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("parseReference(%q) error = %v, want %v", tt.input, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReferenceString(t *testing.T) {
+	ref, err := parseReference("nginx:1.27@" + testDigest)
+	if err != nil {
+		t.Fatalf("parseReference: %v", err)
+	}
+	if want := "docker.io/library/nginx:1.27@" + testDigest; ref.String() != want {
+		t.Fatalf("String() = %q, want %q", ref.String(), want)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ruleAction is what happens to an image matched by a rule.
+type ruleAction string
+
+const (
+	actionRewrite ruleAction = "rewrite"
+	actionSkip    ruleAction = "skip"
+	actionDeny    ruleAction = "deny"
+)
+
+// ruleConfig is an entry of the rules list in registries.yaml:
+//
+//	rules:
+//	  - match: docker.io/bitnami/*   # glob on the normalized repository name
+//	    action: skip
+//	  - regex: ^ghcr\.io/(org-a|org-b)/
+//	    action: rewrite
+//	  - match: ghcr.io/**
+//	    action: skip
+//	  - match: docker.io/licensed/**
+//	    action: deny
+//	    message: cached copies of this image are not allowed
+//
+// Rules are evaluated in order against the repository name without tag or
+// digest (e.g. docker.io/library/nginx) and the first match wins. Images that
+// match no rule are rewritten when their registry is listed in registries.
+type ruleConfig struct {
+	Match   string     `json:"match,omitempty"`
+	Regex   string     `json:"regex,omitempty"`
+	Action  ruleAction `json:"action"`
+	Message string     `json:"message,omitempty"`
+}
+
+// imageRule is a compiled ruleConfig.
+type imageRule struct {
+	name    string
+	re      *regexp.Regexp
+	action  ruleAction
+	message string
+}
+
+// compileRules compiles the configured rules, reporting every invalid rule
+// prefixed with its key.
+func compileRules(rules []ruleConfig) ([]imageRule, error) {
+	var errs []error
+	compiled := make([]imageRule, 0, len(rules))
+	for i, r := range rules {
+		key := fmt.Sprintf("rules[%d]", i)
+		rule := imageRule{action: r.Action, message: r.Message}
+		switch r.Action {
+		case actionRewrite, actionSkip, actionDeny:
+		case "":
+			errs = append(errs, fmt.Errorf("%s.action: is required", key))
+		default:
+			errs = append(errs, fmt.Errorf("%s.action: %q must be one of rewrite, skip or deny", key, r.Action))
+		}
+
+		var err error
+		switch {
+		case r.Match != "" && r.Regex != "":
+			errs = append(errs, fmt.Errorf("%s: only one of match and regex may be set", key))
+			continue
+		case r.Match != "":
+			rule.name = fmt.Sprintf("%s match %q", key, r.Match)
+			rule.re, err = globToRegexp(r.Match)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s.match: %w", key, err))
+			}
+		case r.Regex != "":
+			rule.name = fmt.Sprintf("%s regex %q", key, r.Regex)
+			rule.re, err = regexp.Compile(r.Regex)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s.regex: %w", key, err))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s: one of match or regex is required", key))
+		}
+		compiled = append(compiled, rule)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return compiled, nil
+}
+
+// globToRegexp converts a repository glob into an anchored regular expression.
+// '*' and '?' never cross a '/', while '**' matches any number of path
+// components.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// matchRule returns the first rule matching the repository name.
+func matchRule(rules []imageRule, name string) (imageRule, bool) {
+	for _, r := range rules {
+		if r.re.MatchString(name) {
+			return r, true
+		}
+	}
+	return imageRule{}, false
+}
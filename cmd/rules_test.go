@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		name  string
+		match bool
+	}{
+		{"docker.io/bitnami/*", "docker.io/bitnami/redis", true},
+		{"docker.io/bitnami/*", "docker.io/bitnami/charts/redis", false},
+		{"docker.io/bitnami/*", "docker.io/bitnamilegacy/redis", false},
+		{"ghcr.io/**", "ghcr.io/org/team/app", true},
+		{"ghcr.io/**", "ghcrxio/org/app", false},
+		{"quay.io/org/app-?", "quay.io/org/app-1", true},
+		{"quay.io/org/app-?", "quay.io/org/app-12", false},
+		{"*/library/nginx", "docker.io/library/nginx", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.glob+" "+tt.name, func(t *testing.T) {
+			re, err := globToRegexp(tt.glob)
+			if err != nil {
+				t.Fatalf("globToRegexp(%q): %v", tt.glob, err)
+			}
+			if got := re.MatchString(tt.name); got != tt.match {
+				t.Fatalf("%q matches %q = %v, want %v", tt.glob, tt.name, got, tt.match)
+			}
+		})
+	}
+}
+
+func TestCompileRules_Errors(t *testing.T) {
+	_, err := compileRules([]ruleConfig{
+		{Match: "docker.io/*", Action: "skip"},
+		{Match: "docker.io/*", Regex: "^docker", Action: "skip"},
+		{Regex: "(", Action: "rewrite"},
+		{Match: "ghcr.io/**"},
+		{Match: "quay.io/**", Action: "block"},
+		{Action: "deny"},
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, want := range []string{
+		"rules[1]: only one of match and regex may be set",
+		"rules[2].regex: error parsing regexp",
+		"rules[3].action: is required",
+		`rules[4].action: "block" must be one of rewrite, skip or deny`,
+		"rules[5]: one of match or regex is required",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "rules[0]") {
+		t.Errorf("valid rule reported as invalid: %v", err)
+	}
+}
+
+// setupServerWithRules builds a server for registries and rules without going
+// through the environment.
+func setupServerWithRules(t *testing.T, registries []registryConfig, rules []ruleConfig) *server {
+	t.Helper()
+	srv, err := newServerFromConfig(&config{AWSAccountID: "123456789012", AWSRegion: "us-west-2", Registries: registries, Rules: rules})
+	if err != nil {
+		t.Fatalf("newServerFromConfig: %v", err)
+	}
+	return srv
+}
+
+func TestEvaluateImage_Rules(t *testing.T) {
+	srv := setupServerWithRules(t,
+		[]registryConfig{{Host: "docker.io"}, {Host: "ghcr.io", Prefix: "github"}},
+		[]ruleConfig{
+			{Match: "docker.io/bitnami/*", Action: actionSkip},
+			{Match: "docker.io/licensed/**", Action: actionDeny, Message: "licence forbids caching"},
+			{Regex: `^ghcr\.io/(org-a|org-b)/`, Action: actionRewrite},
+			{Match: "ghcr.io/**", Action: actionSkip},
+			{Match: "quay.io/trusted/*", Action: actionRewrite},
+			{Match: "docker.io/library/*", Action: actionSkip},
+			{Match: "docker.io/library/nginx", Action: actionRewrite},
+		})
+
+	tests := []struct {
+		image  string
+		action ruleAction
+		want   string
+		rule   string
+	}{
+		{"bitnami/redis:7", actionSkip, "", `rules[0] match "docker.io/bitnami/*"`},
+		{"docker.io/licensed/tool", actionDeny, "", `rules[1] match "docker.io/licensed/**"`},
+		{"ghcr.io/org-a/app:1", actionRewrite, "123456789012.dkr.ecr.us-west-2.amazonaws.com/github/org-a/app:1", `rules[2] regex "^ghcr\\.io/(org-a|org-b)/"`},
+		{"ghcr.io/org-c/app:1", actionSkip, "", `rules[3] match "ghcr.io/**"`},
+		{"quay.io/trusted/app", actionRewrite, "123456789012.dkr.ecr.us-west-2.amazonaws.com/quay.io/trusted/app", `rules[4] match "quay.io/trusted/*"`},
+		{"quay.io/other/app", actionSkip, "", ""},
+		{"nginx", actionSkip, "", `rules[5] match "docker.io/library/*"`}, // first match wins
+		{"owner/app", actionRewrite, "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/owner/app", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			d, err := srv.evaluateImage(tt.image)
+			if err != nil {
+				t.Fatalf("evaluateImage(%q): %v", tt.image, err)
+			}
+			if d.Action != tt.action || d.Image != tt.want || d.Rule != tt.rule {
+				t.Fatalf("evaluateImage(%q) = %+v, want action=%s image=%q rule=%q", tt.image, d, tt.action, tt.want, tt.rule)
+			}
+		})
+	}
+
+	t.Run("rewriteImage reports denials", func(t *testing.T) {
+		_, ok, err := srv.rewriteImage("docker.io/licensed/tool")
+		if ok || !errors.Is(err, errImageDenied) {
+			t.Fatalf("rewriteImage = %v, %v; want errImageDenied", ok, err)
+		}
+	})
+}
+
+func TestMutate_DenyRule(t *testing.T) {
+	srv := setupServerWithRules(t,
+		[]registryConfig{{Host: "docker.io"}},
+		[]ruleConfig{{Match: "docker.io/licensed/**", Action: actionDeny, Message: "licence forbids caching"}})
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "nginx"},
+				{Name: "tool", Image: "licensed/tool:1"},
+			},
+		},
+	}
+	out := reviewPod(t, srv, pod)
+	if out.Response.Allowed {
+		t.Fatal("expected pod to be denied")
+	}
+	if out.Response.Result.Code != 403 {
+		t.Errorf("code = %d, want 403", out.Response.Result.Code)
+	}
+	for _, want := range []string{`container "tool"`, "licence forbids caching"} {
+		if !strings.Contains(out.Response.Result.Message, want) {
+			t.Errorf("message %q does not mention %q", out.Response.Result.Message, want)
+		}
+	}
+}
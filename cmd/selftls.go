@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	caValidity      = 10 * 365 * 24 * time.Hour
+	servingValidity = 365 * 24 * time.Hour
+	// renewBefore is how long before expiry the serving certificate is
+	// reissued. The CA is renewed once it would expire before a freshly
+	// issued serving certificate.
+	renewBefore = 30 * 24 * time.Hour
+
+	secretKeyCACert = "ca.crt"
+	secretKeyCAKey  = "ca.key"
+)
+
+// selfManagedTLS issues the webhook's serving certificate from its own CA
+// instead of relying on cert-manager. The CA and certificate live in a
+// Secret shared by all replicas, and the CA bundle is injected into the
+// webhook configurations so the API server trusts the webhook.
+type selfManagedTLS struct {
+	client            kubernetes.Interface
+	namespace         string
+	secretName        string
+	service           string
+	mutatingWebhook   string
+	validatingWebhook string // optional
+	now               func() time.Time
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// newSelfManagedTLSFromEnv configures self-managed TLS from WEBHOOK_NAMESPACE,
+// WEBHOOK_SERVICE, WEBHOOK_TLS_SECRET, WEBHOOK_MUTATING_CONFIG and
+// WEBHOOK_VALIDATING_CONFIG using the in-cluster Kubernetes client.
+func newSelfManagedTLSFromEnv() (*selfManagedTLS, error) {
+	m := &selfManagedTLS{
+		namespace:         os.Getenv("WEBHOOK_NAMESPACE"),
+		service:           os.Getenv("WEBHOOK_SERVICE"),
+		secretName:        os.Getenv("WEBHOOK_TLS_SECRET"),
+		mutatingWebhook:   os.Getenv("WEBHOOK_MUTATING_CONFIG"),
+		validatingWebhook: os.Getenv("WEBHOOK_VALIDATING_CONFIG"),
+		now:               time.Now,
+	}
+	var errs []error
+	for _, env := range []string{"WEBHOOK_NAMESPACE", "WEBHOOK_SERVICE", "WEBHOOK_TLS_SECRET", "WEBHOOK_MUTATING_CONFIG"} {
+		if os.Getenv(env) == "" {
+			errs = append(errs, fmt.Errorf("%s: is required for self-managed TLS", env))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed loading in-cluster config: %w", err)
+	}
+	m.client, err = kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating kubernetes client: %w", err)
+	}
+	return m, nil
+}
+
+// GetCertificate returns the current serving certificate.
+func (m *selfManagedTLS) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, errors.New("serving certificate not issued yet")
+	}
+	return m.cert, nil
+}
+
+// Run re-checks the certificates and CA bundles every interval until ctx is
+// done, rotating certificates before they expire and restoring CA bundles
+// reset by e.g. a Helm upgrade.
+func (m *selfManagedTLS) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.ensure(ctx); err != nil {
+				slog.Error("failed to maintain self-managed TLS", "error", err)
+			}
+		}
+	}
+}
+
+// ensure loads the CA and serving certificate from the Secret, issuing or
+// renewing them as needed, and injects the CA bundle into the webhook
+// configurations. Replicas racing to write the Secret converge on whichever
+// write wins.
+func (m *selfManagedTLS) ensure(ctx context.Context) error {
+	for range 5 {
+		secret, err := m.client.CoreV1().Secrets(m.namespace).Get(ctx, m.secretName, metav1.GetOptions{})
+		exists := err == nil
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed reading secret %s/%s: %w", m.namespace, m.secretName, err)
+		}
+
+		var current *certBundle
+		if exists {
+			current, err = parseCertBundle(secret.Data)
+			if err != nil {
+				slog.Warn("reissuing unreadable TLS secret", "secret", m.secretName, "error", err)
+			}
+		}
+		next, changed, err := m.renew(current)
+		if err != nil {
+			return err
+		}
+
+		if changed {
+			switch {
+			case !exists:
+				secret = &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: m.secretName, Namespace: m.namespace},
+					Type:       corev1.SecretTypeTLS,
+				}
+				secret.Data = next.secretData()
+				_, err = m.client.CoreV1().Secrets(m.namespace).Create(ctx, secret, metav1.CreateOptions{})
+			default:
+				secret.Data = next.secretData()
+				_, err = m.client.CoreV1().Secrets(m.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+			}
+			if apierrors.IsAlreadyExists(err) || apierrors.IsConflict(err) {
+				continue // another replica wrote the secret first
+			}
+			if err != nil {
+				return fmt.Errorf("failed writing secret %s/%s: %w", m.namespace, m.secretName, err)
+			}
+			slog.Info("issued TLS certificate", "secret", m.secretName, "expires", next.leaf.NotAfter)
+		}
+
+		if err := m.setCertificate(next); err != nil {
+			return err
+		}
+		return m.injectCABundle(ctx, next.caPEM)
+	}
+	return fmt.Errorf("secret %s/%s kept changing while issuing certificates", m.namespace, m.secretName)
+}
+
+func (m *selfManagedTLS) setCertificate(b *certBundle) error {
+	pair, err := tls.X509KeyPair(b.certPEM, b.keyPEM)
+	if err != nil {
+		observeCertificate(nil)
+		return fmt.Errorf("failed loading tls key pair: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cert == nil || !bytes.Equal(m.cert.Certificate[0], pair.Certificate[0]) {
+		observeCertificate(&pair)
+	}
+	m.cert = &pair
+	return nil
+}
+
+// dnsNames returns the names the API server may use to reach the service.
+func (m *selfManagedTLS) dnsNames() []string {
+	return []string{
+		m.service,
+		m.service + "." + m.namespace,
+		m.service + "." + m.namespace + ".svc",
+		m.service + "." + m.namespace + ".svc.cluster.local",
+	}
+}
+
+// renew returns b with every certificate that is missing, about to expire or
+// issued for other names replaced, and whether anything changed. A renewed
+// CA is added in front of the previous one, which stays in the bundle until
+// it expires so certificates it issued remain trusted during the rollover.
+func (m *selfManagedTLS) renew(b *certBundle) (*certBundle, bool, error) {
+	now := m.now()
+	next := &certBundle{}
+	changed := false
+	if b != nil {
+		*next = *b
+	}
+
+	if b == nil || now.Add(servingValidity).After(b.caCert.NotAfter) {
+		caCert, caKey, caDER, err := newCA(now)
+		if err != nil {
+			return nil, false, err
+		}
+		bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+		if b != nil {
+			bundle = append(bundle, b.caPEM...)
+		}
+		next.caCert, next.caKey, next.caPEM, next.leaf = caCert, caKey, bundle, nil
+		changed = true
+	}
+	if pruned := pruneExpired(next.caPEM, now); !bytes.Equal(pruned, next.caPEM) {
+		next.caPEM = pruned
+		changed = true
+	}
+
+	if next.leaf == nil || now.Add(renewBefore).After(next.leaf.NotAfter) ||
+		!slices.Equal(next.leaf.DNSNames, m.dnsNames()) || next.leaf.CheckSignatureFrom(next.caCert) != nil {
+		leaf, certPEM, keyPEM, err := newServingCert(now, m.dnsNames(), next.caCert, next.caKey)
+		if err != nil {
+			return nil, false, err
+		}
+		next.leaf, next.certPEM, next.keyPEM = leaf, certPEM, keyPEM
+		changed = true
+	}
+	return next, changed, nil
+}
+
+// injectCABundle sets caBundle on every webhook of the configured webhook
+// configurations. A missing validating configuration is ignored, as
+// validation is optional. A missing mutating configuration is only logged:
+// Helm and kubectl may create it after the Deployment, and Run injects the
+// bundle once it exists.
+func (m *selfManagedTLS) injectCABundle(ctx context.Context, caPEM []byte) error {
+	webhooks := m.client.AdmissionregistrationV1()
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cfg, err := webhooks.MutatingWebhookConfigurations().Get(ctx, m.mutatingWebhook, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			slog.Warn("webhook configuration not found, injecting the CA bundle on the next check", "mutatingwebhookconfiguration", m.mutatingWebhook)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		changed := false
+		for i := range cfg.Webhooks {
+			if !bytes.Equal(cfg.Webhooks[i].ClientConfig.CABundle, caPEM) {
+				cfg.Webhooks[i].ClientConfig.CABundle = caPEM
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		_, err = webhooks.MutatingWebhookConfigurations().Update(ctx, cfg, metav1.UpdateOptions{})
+		if err == nil {
+			slog.Info("injected CA bundle", "mutatingwebhookconfiguration", m.mutatingWebhook)
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed injecting CA bundle into %s: %w", m.mutatingWebhook, err)
+	}
+
+	if m.validatingWebhook == "" {
+		return nil
+	}
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cfg, err := webhooks.ValidatingWebhookConfigurations().Get(ctx, m.validatingWebhook, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		changed := false
+		for i := range cfg.Webhooks {
+			if !bytes.Equal(cfg.Webhooks[i].ClientConfig.CABundle, caPEM) {
+				cfg.Webhooks[i].ClientConfig.CABundle = caPEM
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		_, err = webhooks.ValidatingWebhookConfigurations().Update(ctx, cfg, metav1.UpdateOptions{})
+		if err == nil {
+			slog.Info("injected CA bundle", "validatingwebhookconfiguration", m.validatingWebhook)
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed injecting CA bundle into %s: %w", m.validatingWebhook, err)
+	}
+	return nil
+}
+
+// certBundle is the content of the TLS Secret.
+type certBundle struct {
+	caCert          *x509.Certificate // current CA, the first certificate of caPEM
+	caKey           *ecdsa.PrivateKey
+	caPEM           []byte // CA bundle injected into the webhook configurations
+	leaf            *x509.Certificate
+	certPEM, keyPEM []byte
+}
+
+func (b *certBundle) secretData() map[string][]byte {
+	caKeyDER, _ := x509.MarshalECPrivateKey(b.caKey) // cannot fail for P-256 keys
+	return map[string][]byte{
+		secretKeyCACert:         b.caPEM,
+		secretKeyCAKey:          pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: caKeyDER}),
+		corev1.TLSCertKey:       b.certPEM,
+		corev1.TLSPrivateKeyKey: b.keyPEM,
+	}
+}
+
+// parseCertBundle reads a Secret written by secretData.
+func parseCertBundle(data map[string][]byte) (*certBundle, error) {
+	caBlock, _ := pem.Decode(data[secretKeyCACert])
+	if caBlock == nil {
+		return nil, fmt.Errorf("%s: no PEM certificate", secretKeyCACert)
+	}
+	caCert, err := x509.ParseCertificate(caBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", secretKeyCACert, err)
+	}
+	keyBlock, _ := pem.Decode(data[secretKeyCAKey])
+	if keyBlock == nil {
+		return nil, fmt.Errorf("%s: no PEM key", secretKeyCAKey)
+	}
+	caKey, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", secretKeyCAKey, err)
+	}
+	b := &certBundle{caCert: caCert, caKey: caKey, caPEM: data[secretKeyCACert]}
+
+	// A missing or broken serving certificate is simply reissued.
+	if pair, err := tls.X509KeyPair(data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey]); err == nil {
+		b.leaf, b.certPEM, b.keyPEM = pair.Leaf, data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey]
+	}
+	return b, nil
+}
+
+// pruneExpired drops expired certificates from a PEM bundle.
+func pruneExpired(bundle []byte, now time.Time) []byte {
+	var out []byte
+	for rest := bundle; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return out
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil && now.Before(cert.NotAfter) {
+			out = append(out, pem.EncodeToMemory(block)...)
+		}
+	}
+}
+
+func newCA(now time.Time) (*x509.Certificate, *ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed generating CA key: %w", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "ecr-pull-through-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed creating CA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return cert, key, der, nil
+}
+
+func newServingCert(now time.Time, dnsNames []string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, []byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed generating serving key: %w", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: dnsNames[len(dnsNames)-2]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(servingValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed creating serving certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return cert,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		nil
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
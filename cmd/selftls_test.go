@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// setupSelfManagedTLS returns a selfManagedTLS backed by a fake clientset
+// holding a MutatingWebhookConfiguration with two webhooks and the given
+// objects, with the clock set to now.
+func setupSelfManagedTLS(t *testing.T, now *time.Time, objects ...metav1.Object) (*selfManagedTLS, *fake.Clientset) {
+	t.Helper()
+	client := fake.NewClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "ecr-pull-through"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "a.example.com"}, {Name: "b.example.com"}},
+	})
+	for _, obj := range objects {
+		var err error
+		switch o := obj.(type) {
+		case *admissionregistrationv1.ValidatingWebhookConfiguration:
+			_, err = client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Create(context.Background(), o, metav1.CreateOptions{})
+		case *corev1.Secret:
+			_, err = client.CoreV1().Secrets(o.Namespace).Create(context.Background(), o, metav1.CreateOptions{})
+		default:
+			t.Fatalf("unsupported object %T", obj)
+		}
+		if err != nil {
+			t.Fatalf("create %T: %v", obj, err)
+		}
+	}
+	return &selfManagedTLS{
+		client:            client,
+		namespace:         "webhooks",
+		secretName:        "ecr-pull-through-tls",
+		service:           "ecr-pull-through",
+		mutatingWebhook:   "ecr-pull-through",
+		validatingWebhook: "ecr-pull-through",
+		now:               func() time.Time { return *now },
+	}, client
+}
+
+// getSecret returns the TLS secret from the fake clientset.
+func getSecret(t *testing.T, client *fake.Clientset) *corev1.Secret {
+	t.Helper()
+	secret, err := client.CoreV1().Secrets("webhooks").Get(context.Background(), "ecr-pull-through-tls", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get secret: %v", err)
+	}
+	return secret
+}
+
+// servingCert returns the parsed serving certificate of m.
+func servingCert(t *testing.T, m *selfManagedTLS) *x509.Certificate {
+	t.Helper()
+	cert, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return leaf
+}
+
+// verifyServingCert checks the serving certificate against caPEM the way the
+// API server does when calling the webhook service.
+func verifyServingCert(t *testing.T, leaf *x509.Certificate, caPEM []byte, now time.Time) {
+	t.Helper()
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatal("CA bundle holds no certificates")
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "ecr-pull-through.webhooks.svc", CurrentTime: now}); err != nil {
+		t.Fatalf("serving certificate does not verify against the CA bundle: %v", err)
+	}
+}
+
+func countCerts(bundle []byte) int {
+	n := 0
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		n++
+	}
+	return n
+}
+
+func TestSelfManagedTLS_Bootstrap(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	m, client := setupSelfManagedTLS(t, &now, &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "ecr-pull-through"},
+		Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: "validate.example.com"}},
+	})
+	ctx := context.Background()
+
+	if _, err := m.GetCertificate(nil); err == nil {
+		t.Fatal("expected an error before the certificate is issued")
+	}
+	if err := m.ensure(ctx); err != nil {
+		t.Fatalf("ensure: %v", err)
+	}
+
+	secret := getSecret(t, client)
+	if secret.Type != corev1.SecretTypeTLS {
+		t.Errorf("secret type = %q, want %q", secret.Type, corev1.SecretTypeTLS)
+	}
+	caPEM := secret.Data["ca.crt"]
+	leaf := servingCert(t, m)
+	verifyServingCert(t, leaf, caPEM, now)
+	if !bytes.Equal(secret.Data["tls.crt"], pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})) {
+		t.Error("served certificate differs from the secret")
+	}
+
+	mwc, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "ecr-pull-through", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get mutatingwebhookconfiguration: %v", err)
+	}
+	for _, wh := range mwc.Webhooks {
+		if !bytes.Equal(wh.ClientConfig.CABundle, caPEM) {
+			t.Errorf("webhook %s caBundle not injected", wh.Name)
+		}
+	}
+	vwc, err := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, "ecr-pull-through", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get validatingwebhookconfiguration: %v", err)
+	}
+	if !bytes.Equal(vwc.Webhooks[0].ClientConfig.CABundle, caPEM) {
+		t.Error("validating webhook caBundle not injected")
+	}
+
+	t.Run("other replicas reuse the secret", func(t *testing.T) {
+		other := &selfManagedTLS{
+			client:          client,
+			namespace:       m.namespace,
+			secretName:      m.secretName,
+			service:         m.service,
+			mutatingWebhook: m.mutatingWebhook,
+			now:             m.now,
+		}
+		if err := other.ensure(ctx); err != nil {
+			t.Fatalf("ensure: %v", err)
+		}
+		if !servingCert(t, other).Equal(leaf) {
+			t.Fatal("second replica issued a new certificate")
+		}
+		if got := getSecret(t, client).ResourceVersion; got != secret.ResourceVersion {
+			t.Fatalf("secret rewritten: resourceVersion %s -> %s", secret.ResourceVersion, got)
+		}
+	})
+
+	t.Run("reset caBundle is restored", func(t *testing.T) {
+		mwc.Webhooks[0].ClientConfig.CABundle = nil
+		if _, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Update(ctx, mwc, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+		if err := m.ensure(ctx); err != nil {
+			t.Fatalf("ensure: %v", err)
+		}
+		got, _ := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "ecr-pull-through", metav1.GetOptions{})
+		if !bytes.Equal(got.Webhooks[0].ClientConfig.CABundle, caPEM) {
+			t.Fatal("caBundle not restored")
+		}
+	})
+}
+
+func TestSelfManagedTLS_Rotation(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	m, client := setupSelfManagedTLS(t, &now)
+	ctx := context.Background()
+	if err := m.ensure(ctx); err != nil {
+		t.Fatalf("ensure: %v", err)
+	}
+	firstLeaf := servingCert(t, m)
+	firstCA := getSecret(t, client).Data["ca.crt"]
+
+	t.Run("serving certificate is renewed before expiry", func(t *testing.T) {
+		now = firstLeaf.NotAfter.Add(-renewBefore + time.Hour)
+		if err := m.ensure(ctx); err != nil {
+			t.Fatalf("ensure: %v", err)
+		}
+		leaf := servingCert(t, m)
+		if leaf.Equal(firstLeaf) {
+			t.Fatal("serving certificate was not renewed")
+		}
+		caPEM := getSecret(t, client).Data["ca.crt"]
+		if !bytes.Equal(caPEM, firstCA) {
+			t.Fatal("CA changed although it is far from expiry")
+		}
+		verifyServingCert(t, leaf, caPEM, now)
+	})
+
+	t.Run("CA is renewed and the old one kept in the bundle", func(t *testing.T) {
+		now = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).Add(caValidity - servingValidity + time.Hour)
+		if err := m.ensure(ctx); err != nil {
+			t.Fatalf("ensure: %v", err)
+		}
+		caPEM := getSecret(t, client).Data["ca.crt"]
+		if n := countCerts(caPEM); n != 2 {
+			t.Fatalf("CA bundle holds %d certificates, want 2", n)
+		}
+		if !bytes.HasSuffix(caPEM, firstCA) {
+			t.Fatal("previous CA missing from the bundle")
+		}
+		verifyServingCert(t, servingCert(t, m), caPEM[:len(caPEM)-len(firstCA)], now)
+	})
+
+	t.Run("expired CAs are dropped from the bundle", func(t *testing.T) {
+		now = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).Add(caValidity + time.Hour)
+		if err := m.ensure(ctx); err != nil {
+			t.Fatalf("ensure: %v", err)
+		}
+		if n := countCerts(getSecret(t, client).Data["ca.crt"]); n != 1 {
+			t.Fatalf("CA bundle holds %d certificates, want 1", n)
+		}
+	})
+}
+
+func TestSelfManagedTLS_InvalidSecret(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	m, client := setupSelfManagedTLS(t, &now, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "ecr-pull-through-tls", Namespace: "webhooks"},
+		Type:       corev1.SecretTypeTLS,
+		Data:       map[string][]byte{"tls.crt": []byte("garbage"), "tls.key": []byte("garbage")},
+	})
+	if err := m.ensure(context.Background()); err != nil {
+		t.Fatalf("ensure: %v", err)
+	}
+	verifyServingCert(t, servingCert(t, m), getSecret(t, client).Data["ca.crt"], now)
+}
+
+func TestSelfManagedTLS_MissingWebhookConfiguration(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	m, client := setupSelfManagedTLS(t, &now)
+	m.mutatingWebhook = "created-later"
+	ctx := context.Background()
+
+	// The pod starts before the MutatingWebhookConfiguration exists.
+	if err := m.ensure(ctx); err != nil {
+		t.Fatalf("ensure: %v", err)
+	}
+	servingCert(t, m)
+
+	_, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Create(ctx, &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "created-later"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "a.example.com"}},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("create webhook configuration: %v", err)
+	}
+	if err := m.ensure(ctx); err != nil {
+		t.Fatalf("ensure: %v", err)
+	}
+	cfg, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "created-later", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get webhook configuration: %v", err)
+	}
+	if ca := getSecret(t, client).Data["ca.crt"]; !bytes.Equal(cfg.Webhooks[0].ClientConfig.CABundle, ca) {
+		t.Errorf("caBundle was not injected once the configuration exists")
+	}
+}
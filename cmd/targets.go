@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// defaultTarget names the ECR registry of awsAccountId and awsRegion.
+const defaultTarget = "default"
+
+// targetKey is the namespace label or annotation naming the ECR target of
+// the namespace's workloads.
+const targetKey = "ecr-pull-through/target"
+
+// targetNamePattern restricts target names to valid label values.
+var targetNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// namespacePattern matches namespace names (DNS labels).
+var namespacePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// targetConfig is an entry of the targets list in registries.yaml, an
+// additional ECR registry that pull-through caches can be served from:
+//
+//	targets:
+//	  - name: team-a
+//	    awsAccountId: "111111111111"
+//	    awsRegion: eu-west-1
+//	    ecrHostname: ""     # optional, as at the top level
+//	namespaceTargets:       # namespace -> target name
+//	  payments: team-a
+//
+// Each request is served from the target named by the ecr-pull-through/target
+// label or annotation of its namespace, else the one namespaceTargets maps
+// the namespace to, else the "default" target of awsAccountId and awsRegion.
+// The pull-through cache rules of every target need the same registries.
+type targetConfig struct {
+	Name         string `json:"name"`
+	AWSAccountID string `json:"awsAccountId"`
+	AWSRegion    string `json:"awsRegion"`
+	ECRHostname  string `json:"ecrHostname,omitempty"`
+}
+
+// defaultTarget returns the target of awsAccountId, awsRegion and
+// ecrHostname.
+func (c *config) defaultTarget() targetConfig {
+	return targetConfig{Name: defaultTarget, AWSAccountID: c.AWSAccountID, AWSRegion: c.AWSRegion, ECRHostname: c.ECRHostname}
+}
+
+// ecrTarget is a registry images are rewritten to.
+type ecrTarget struct {
+	// hostname is the registry hostname with a trailing slash.
+	hostname string
+	// registry is the account, region and partition of hostname, taken from
+	// the config when ecrHostname is not an ECR registry hostname.
+	registry ecrRegistry
+}
+
+// target returns the registry of the target at endpoint; ecrHostname
+// replaces the derived hostname.
+func (t targetConfig) target(endpoint ecrEndpoint) ecrTarget {
+	if t.ECRHostname == "" {
+		hostname := ecrHostname(t.AWSAccountID, t.AWSRegion, endpoint)
+		registry, _ := parseECRHostname(strings.TrimSuffix(hostname, "/"))
+		return ecrTarget{hostname: hostname, registry: registry}
+	}
+	registry, ok := parseECRHostname(t.ECRHostname)
+	if !ok {
+		registry = ecrRegistry{AccountID: t.AWSAccountID, Region: t.AWSRegion, Partition: partitionOf(t.AWSRegion).name, Endpoint: endpoint}
+	}
+	return ecrTarget{hostname: t.ECRHostname + "/", registry: registry}
+}
+
+// validateHostname reports an invalid ecrHostname, or an endpoint the
+// partition of the target's region does not offer, prefixed with key.
+func (t targetConfig) validateHostname(key string, endpoint ecrEndpoint) error {
+	if t.ECRHostname != "" {
+		if !hostnamePattern.MatchString(t.ECRHostname) {
+			return fmt.Errorf("%secrHostname: %q is not a valid registry hostname", key, t.ECRHostname)
+		}
+		return nil
+	}
+	return validateEndpoint(key+"awsRegion", t.AWSRegion, endpoint)
+}
+
+// validateTargets reports every invalid targets and namespaceTargets entry,
+// prefixed with its key.
+func (c *config) validateTargets() error {
+	var errs []error
+	names := map[string]bool{defaultTarget: true}
+	for i, t := range c.Targets {
+		key := fmt.Sprintf("targets[%d]", i)
+		switch {
+		case t.Name == "":
+			errs = append(errs, fmt.Errorf("%s.name: is required", key))
+		case t.Name == defaultTarget:
+			errs = append(errs, fmt.Errorf("%s.name: %q is reserved for awsAccountId and awsRegion", key, t.Name))
+		case !targetNamePattern.MatchString(t.Name) || len(t.Name) > 63:
+			errs = append(errs, fmt.Errorf("%s.name: %q must be a lowercase label value", key, t.Name))
+		case names[t.Name]:
+			errs = append(errs, fmt.Errorf("%s.name: %q is listed more than once", key, t.Name))
+		}
+		names[t.Name] = true
+		if !accountIDPattern.MatchString(t.AWSAccountID) {
+			errs = append(errs, fmt.Errorf("%s.awsAccountId: %q must be a 12-digit AWS account ID", key, t.AWSAccountID))
+		}
+		if !regionPattern.MatchString(t.AWSRegion) {
+			errs = append(errs, fmt.Errorf("%s.awsRegion: %q is not a valid AWS region", key, t.AWSRegion))
+		}
+		if err := t.validateHostname(key+".", c.ECREndpoint); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for ns, target := range c.NamespaceTargets {
+		if !namespacePattern.MatchString(ns) {
+			errs = append(errs, fmt.Errorf("namespaceTargets: %q is not a valid namespace name", ns))
+		}
+		if !names[target] {
+			errs = append(errs, fmt.Errorf("namespaceTargets[%s]: target %q is not defined in targets", ns, target))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// namespaceLookup returns the labels and annotations of a namespace.
+type namespaceLookup func(name string) (labels, annotations map[string]string, err error)
+
+// targetFor returns the ECR registry serving namespace, and a warning when
+// the namespace names a target that does not exist.
+func (s *server) targetFor(namespace string) (target ecrTarget, warning string) {
+	if len(s.targets) <= 1 || namespace == "" {
+		return s.targets[defaultTarget], ""
+	}
+	if s.namespaces != nil {
+		labels, annotations, err := s.namespaces(namespace)
+		if err != nil {
+			slog.Warn("failed to look up namespace target", "namespace", namespace, "error", err)
+		}
+		for _, m := range []map[string]string{labels, annotations} {
+			name, ok := m[targetKey]
+			if !ok {
+				continue
+			}
+			if target, ok := s.targets[name]; ok {
+				return target, ""
+			}
+			target = s.targets[s.namespaceTarget(namespace)]
+			return target, fmt.Sprintf("namespace %s: %s %q is not a configured target, images are cached in %s", namespace, targetKey, name, strings.TrimSuffix(target.hostname, "/"))
+		}
+	}
+	return s.targets[s.namespaceTarget(namespace)], ""
+}
+
+// namespaceTarget returns the target namespaceTargets maps namespace to.
+func (s *server) namespaceTarget(namespace string) string {
+	if name, ok := s.namespaceTargets[namespace]; ok {
+		return name
+	}
+	return defaultTarget
+}
+
+// namespaceCache looks up namespaces through the API server, remembering
+// them for ttl so admission requests rarely wait on the lookup.
+type namespaceCache struct {
+	client kubernetes.Interface
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]namespaceCacheEntry
+}
+
+type namespaceCacheEntry struct {
+	labels, annotations map[string]string
+	expires             time.Time
+}
+
+func newNamespaceCache(client kubernetes.Interface, ttl time.Duration) *namespaceCache {
+	return &namespaceCache{client: client, ttl: ttl, now: time.Now, entries: map[string]namespaceCacheEntry{}}
+}
+
+// Lookup is a namespaceLookup. Failed lookups are not cached.
+func (c *namespaceCache) Lookup(name string) (map[string]string, map[string]string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[name]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.labels, entry.annotations, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ns, err := c.client.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	entry = namespaceCacheEntry{labels: ns.Labels, annotations: ns.Annotations, expires: c.now().Add(c.ttl)}
+	c.mu.Lock()
+	c.entries[name] = entry
+	c.mu.Unlock()
+	return entry.labels, entry.annotations, nil
+}
+
+// warnTargets tells users of generated policies that they only rewrite to
+// the default target.
+func (s *server) warnTargets(stderr io.Writer, generated string) {
+	if len(s.targets) > 1 {
+		fmt.Fprintf(stderr, "warning: %s only use the default target %s, targets and namespaceTargets are ignored\n", generated, strings.TrimSuffix(s.ecrRegistryHostname, "/"))
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func setupServerWithTargets(t *testing.T, namespaces map[string]metav1.ObjectMeta) *server {
+	t.Helper()
+	srv, err := newServerFromConfig(&config{
+		AWSAccountID: "123456789012",
+		AWSRegion:    "us-west-2",
+		Registries:   []registryConfig{{Host: "docker.io"}},
+		Targets: []targetConfig{
+			{Name: "team-a", AWSAccountID: "111111111111", AWSRegion: "eu-west-1"},
+			{Name: "team-b", AWSAccountID: "222222222222", AWSRegion: "us-east-1"},
+		},
+		NamespaceTargets: map[string]string{"payments": "team-a", "legacy": "default"},
+	})
+	if err != nil {
+		t.Fatalf("newServerFromConfig: %v", err)
+	}
+	srv.namespaces = func(name string) (map[string]string, map[string]string, error) {
+		meta, ok := namespaces[name]
+		if !ok {
+			return nil, nil, errors.New("namespace not found")
+		}
+		return meta.Labels, meta.Annotations, nil
+	}
+	return srv
+}
+
+func TestTargetFor(t *testing.T) {
+	srv := setupServerWithTargets(t, map[string]metav1.ObjectMeta{
+		"payments": {Labels: map[string]string{targetKey: "team-b"}},
+		"checkout": {Annotations: map[string]string{targetKey: "team-b"}},
+		"both":     {Labels: map[string]string{targetKey: "team-a"}, Annotations: map[string]string{targetKey: "team-b"}},
+		"legacy":   {},
+		"typo":     {Labels: map[string]string{targetKey: "team-c"}},
+	})
+
+	tests := []struct {
+		namespace   string
+		want        string
+		wantWarning bool
+	}{
+		{namespace: "payments", want: "222222222222.dkr.ecr.us-east-1.amazonaws.com/"},
+		{namespace: "checkout", want: "222222222222.dkr.ecr.us-east-1.amazonaws.com/"},
+		{namespace: "both", want: "111111111111.dkr.ecr.eu-west-1.amazonaws.com/"},
+		{namespace: "legacy", want: "123456789012.dkr.ecr.us-west-2.amazonaws.com/"},
+		{namespace: "other", want: "123456789012.dkr.ecr.us-west-2.amazonaws.com/"},
+		{namespace: "typo", want: "123456789012.dkr.ecr.us-west-2.amazonaws.com/", wantWarning: true},
+		{namespace: "", want: "123456789012.dkr.ecr.us-west-2.amazonaws.com/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			got, warning := srv.targetFor(tt.namespace)
+			if got.hostname != tt.want {
+				t.Errorf("targetFor(%q) = %q, want %q", tt.namespace, got.hostname, tt.want)
+			}
+			if (warning != "") != tt.wantWarning {
+				t.Errorf("targetFor(%q) warning = %q, want warning %v", tt.namespace, warning, tt.wantWarning)
+			}
+		})
+	}
+
+	t.Run("namespaceTargets without lookup", func(t *testing.T) {
+		srv.namespaces = nil
+		if got, _ := srv.targetFor("payments"); got.hostname != "111111111111.dkr.ecr.eu-west-1.amazonaws.com/" {
+			t.Errorf("targetFor(payments) = %q, want the team-a registry", got.hostname)
+		}
+	})
+}
+
+func TestMutate_Targets(t *testing.T) {
+	srv := setupServerWithTargets(t, map[string]metav1.ObjectMeta{
+		"team-b": {Labels: map[string]string{targetKey: "team-b"}},
+		"typo":   {Labels: map[string]string{targetKey: "team-c"}},
+	})
+	pod := func(namespace, image string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: namespace},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}},
+		}
+	}
+
+	checkMutatePatch(t, srv, pod("team-b", "nginx:1.27"), map[string]string{
+		"/spec/containers/0/image": "222222222222.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/nginx:1.27",
+	})
+	checkMutatePatch(t, srv, pod("payments", "nginx:1.27"), map[string]string{
+		"/spec/containers/0/image": "111111111111.dkr.ecr.eu-west-1.amazonaws.com/docker.io/library/nginx:1.27",
+	})
+	// Images already cached in the namespace's target are left alone.
+	checkMutatePatch(t, srv, pod("payments", "111111111111.dkr.ecr.eu-west-1.amazonaws.com/docker.io/library/nginx:1.27"), map[string]string{})
+
+	out := reviewPod(t, srv, pod("typo", "nginx:1.27"))
+	if got := imagePatches(t, out)["/spec/containers/0/image"]; got != "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx:1.27" {
+		t.Errorf("patch for unknown target = %q, want the default registry", got)
+	}
+	want := `namespace typo: ecr-pull-through/target "team-c" is not a configured target, images are cached in 123456789012.dkr.ecr.us-west-2.amazonaws.com`
+	if !slices.Contains(out.Response.Warnings, want) {
+		t.Errorf("warnings = %q, want %q", out.Response.Warnings, want)
+	}
+}
+
+func TestNamespaceCache(t *testing.T) {
+	client := fake.NewClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   "payments",
+		Labels: map[string]string{targetKey: "team-a"},
+	}})
+	now := time.Unix(0, 0)
+	cache := newNamespaceCache(client, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	labels, _, err := cache.Lookup("payments")
+	if err != nil || labels[targetKey] != "team-a" {
+		t.Fatalf("Lookup(payments) = %v, %v; want the team-a label", labels, err)
+	}
+	if _, _, err := cache.Lookup("missing"); err == nil {
+		t.Error("Lookup(missing): expected error")
+	}
+
+	ns, _ := client.CoreV1().Namespaces().Get(t.Context(), "payments", metav1.GetOptions{})
+	ns.Labels[targetKey] = "team-b"
+	if _, err := client.CoreV1().Namespaces().Update(t.Context(), ns, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update namespace: %v", err)
+	}
+	if labels, _, _ := cache.Lookup("payments"); labels[targetKey] != "team-a" {
+		t.Errorf("cached label = %q, want team-a until the entry expires", labels[targetKey])
+	}
+	now = now.Add(time.Minute)
+	if labels, _, _ := cache.Lookup("payments"); labels[targetKey] != "team-b" {
+		t.Errorf("label after expiry = %q, want team-b", labels[targetKey])
+	}
+}
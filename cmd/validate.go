@@ -0,0 +1,132 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// validationScope selects which images /validate rejects.
+type validationScope string
+
+const (
+	// scopeConfigured rejects images that reference a configured upstream
+	// registry directly instead of through the pull-through cache.
+	scopeConfigured validationScope = "configured"
+	// scopeAll additionally rejects images from any other non-ECR registry,
+	// unless a skip rule exempts them.
+	scopeAll validationScope = "all"
+)
+
+func (s *server) handleValidate(w http.ResponseWriter, r *http.Request) {
+	serveReview(w, r, "validate", s.validate)
+}
+
+// validate rejects objects with images that bypass the pull-through cache.
+// It is meant to run after mutation as a safety net for pods the mutating
+// webhook missed, e.g. because it failed open. On UPDATE only images that
+// changed are checked, so existing pods can still be updated and deleted.
+func (s *server) validate(body []byte) (_ []byte, err error) {
+	var ar *admissionv1.AdmissionRequest
+	resp := admissionv1.AdmissionResponse{}
+	defer func() { observeAdmission("validate", ar, &resp, err) }()
+
+	admReview := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, &admReview); err != nil {
+		return nil, fmt.Errorf("unmarshaling request failed with %s", err)
+	}
+	if err := checkReviewVersion(admReview.APIVersion); err != nil {
+		return nil, err
+	}
+	ar = admReview.Request
+	if ar == nil {
+		return []byte{}, nil
+	}
+
+	obj, fields, err := s.imageFields(ar.Kind, ar.Object.Raw)
+	if err != nil {
+		return nil, err
+	}
+	namespace, kind, name := ar.Namespace, ar.Kind.Kind, ar.Name
+	if obj != nil {
+		namespace, kind, name = cmp.Or(namespace, obj.meta.Namespace), obj.kind, obj.name()
+	}
+
+	previous, err := s.previousImages(ar)
+	if err != nil {
+		return nil, err
+	}
+
+	target, _ := s.targetFor(namespace)
+	var rejections []string
+	code := int32(http.StatusForbidden)
+	for _, f := range fields {
+		if old, ok := previous[f.path]; f.image == "" || ok && old == f.image {
+			continue
+		}
+		reason, err := s.checkImage(f.image, target)
+		if err != nil {
+			rejections = append(rejections, fmt.Sprintf("%s: %s", f.label(), err))
+			if !errors.Is(err, errImageDenied) {
+				code = http.StatusBadRequest
+			}
+			continue
+		}
+		if reason != "" {
+			rejections = append(rejections, fmt.Sprintf("%s: %s", f.label(), reason))
+		}
+	}
+
+	resp.UID, resp.Allowed = ar.UID, true
+	switch {
+	case len(rejections) == 0:
+	case s.isDryRun(namespace):
+		slog.Warn("dry run: would reject object", "namespace", namespace, "kind", kind, "name", name, "errors", rejections)
+		resp.Warnings, resp.AuditAnnotations, err = dryRunReport(nil, rejections)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		slog.Warn("rejected object", "namespace", namespace, "kind", kind, "name", name, "errors", rejections)
+		resp.Allowed = false
+		resp.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    code,
+			Reason:  statusReason(code),
+			Message: strings.Join(rejections, "; "),
+		}
+	}
+	return marshalReview(admReview, resp)
+}
+
+// checkImage returns why image bypasses the pull-through cache of target, or ""
+// when it may be admitted. Invalid and denied images return an error like
+// rewriteImage does.
+func (s *server) checkImage(image string, target ecrTarget) (string, error) {
+	d, err := s.evaluateImageAt(image, target)
+	if err != nil {
+		return "", err
+	}
+	ref, err := s.parseImage(image)
+	if err != nil {
+		return "", err
+	}
+	switch d.Action {
+	case actionRewrite:
+		return fmt.Sprintf("image %q is pulled directly from upstream registry %s, use the cached image %q", image, ref.Domain, d.Image), nil
+	case actionDeny:
+		return "", denyError(image, d)
+	}
+	if s.validationScope == scopeAll && d.Rule == "" && !isEcrRegistry(ref.Domain) {
+		cached := target.hostname + defaultPrefix(ref.Domain+"/") + ref.Path + ref.Suffix()
+		return fmt.Sprintf("image %q is not pulled through ECR, use the cached image %q", image, cached), nil
+	}
+	return "", nil
+}
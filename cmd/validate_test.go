@@ -0,0 +1,215 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	v1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// validatePod sends pod through validate, with old as the previous object
+// of an UPDATE when it is not nil, and returns the decoded AdmissionReview.
+func validatePod(t *testing.T, srv *server, pod, old *corev1.Pod) v1beta1.AdmissionReview {
+	t.Helper()
+	req := &v1beta1.AdmissionRequest{UID: "test-uid", Operation: v1beta1.Create}
+	var err error
+	if req.Object.Raw, err = json.Marshal(pod); err != nil {
+		t.Fatalf("marshal pod: %v", err)
+	}
+	if old != nil {
+		req.Operation = v1beta1.Update
+		if req.OldObject.Raw, err = json.Marshal(old); err != nil {
+			t.Fatalf("marshal old pod: %v", err)
+		}
+	}
+	body, err := json.Marshal(&v1beta1.AdmissionReview{Request: req})
+	if err != nil {
+		t.Fatalf("marshal admissionreview: %v", err)
+	}
+	validated, err := srv.validate(body)
+	if err != nil {
+		t.Fatalf("validate error: %v", err)
+	}
+	out := v1beta1.AdmissionReview{}
+	if err := json.Unmarshal(validated, &out); err != nil {
+		t.Fatalf("unmarshal validated review: %v", err)
+	}
+	if out.Response == nil {
+		t.Fatalf("response is nil")
+	}
+	return out
+}
+
+func podWithImages(images ...string) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"}}
+	for i, image := range images {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: fmt.Sprintf("c%d", i), Image: image})
+	}
+	return pod
+}
+
+func TestValidate(t *testing.T) {
+	srv := setupServerWithRules(t,
+		[]registryConfig{{Host: "docker.io"}, {Host: "ghcr.io"}},
+		[]ruleConfig{
+			{Match: "quay.io/exempt/**", Action: actionSkip},
+			{Match: "docker.io/licensed/**", Action: actionDeny, Message: "licence forbids caching"},
+		})
+	ecr := srv.ecrRegistryHostname
+
+	tests := []struct {
+		name        string
+		scope       validationScope
+		images      []string
+		wantAllowed bool
+		wantCode    int32
+		wantMessage []string
+	}{
+		{
+			name:        "cached images are allowed",
+			images:      []string{ecr + "docker.io/library/nginx:1.27", ecr + "ghcr.io/org/app:1"},
+			wantAllowed: true,
+		},
+		{
+			name:        "other ECR registries are allowed",
+			scope:       scopeAll,
+			images:      []string{"111111111111.dkr.ecr.eu-west-1.amazonaws.com/team/app:1"},
+			wantAllowed: true,
+		},
+		{
+			name:     "configured upstream is rejected",
+			images:   []string{ecr + "ghcr.io/org/app:1", "nginx:1.27"},
+			wantCode: 403,
+			wantMessage: []string{
+				`container "c1": image "nginx:1.27" is pulled directly from upstream registry docker.io`,
+				`use the cached image "` + ecr + `docker.io/library/nginx:1.27"`,
+			},
+		},
+		{
+			name:        "unconfigured registry is allowed by default",
+			images:      []string{"quay.io/org/app:1"},
+			wantAllowed: true,
+		},
+		{
+			name:        "unconfigured registry is rejected with scope all",
+			scope:       scopeAll,
+			images:      []string{"quay.io/org/app:1"},
+			wantCode:    403,
+			wantMessage: []string{`container "c0": image "quay.io/org/app:1" is not pulled through ECR, use the cached image "` + ecr + `quay.io/org/app:1"`},
+		},
+		{
+			name:        "skip rules exempt images with scope all",
+			scope:       scopeAll,
+			images:      []string{"quay.io/exempt/tool:1"},
+			wantAllowed: true,
+		},
+		{
+			name:        "deny rules reject",
+			images:      []string{"licensed/tool:1"},
+			wantCode:    403,
+			wantMessage: []string{`container "c0"`, "licence forbids caching"},
+		},
+		{
+			name:        "invalid references are rejected",
+			images:      []string{"Nginx"},
+			wantCode:    400,
+			wantMessage: []string{`container "c0"`, `invalid image reference "Nginx"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv.validationScope = cmp.Or(tt.scope, scopeConfigured)
+			out := validatePod(t, srv, podWithImages(tt.images...), nil)
+			if out.Response.Allowed != tt.wantAllowed {
+				t.Fatalf("allowed = %v, want %v (%v)", out.Response.Allowed, tt.wantAllowed, out.Response.Result)
+			}
+			if len(out.Response.Patch) != 0 {
+				t.Errorf("unexpected patch %s", out.Response.Patch)
+			}
+			if tt.wantAllowed {
+				return
+			}
+			if out.Response.Result.Code != tt.wantCode {
+				t.Errorf("code = %d, want %d", out.Response.Result.Code, tt.wantCode)
+			}
+			for _, want := range tt.wantMessage {
+				if !strings.Contains(out.Response.Result.Message, want) {
+					t.Errorf("message %q does not mention %q", out.Response.Result.Message, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidate_Update(t *testing.T) {
+	srv := setupServer(t, "123456789012", "us-west-2", "docker.io")
+	old := podWithImages("nginx:1.27", "busybox")
+
+	t.Run("unchanged images are allowed", func(t *testing.T) {
+		pod := old.DeepCopy()
+		pod.Labels = map[string]string{"touched": "true"}
+		if out := validatePod(t, srv, pod, old); !out.Response.Allowed {
+			t.Fatalf("expected update to be allowed, got %v", out.Response.Result)
+		}
+	})
+
+	t.Run("changed images are checked", func(t *testing.T) {
+		pod := old.DeepCopy()
+		pod.Spec.Containers[1].Image = "busybox:1.37"
+		out := validatePod(t, srv, pod, old)
+		if out.Response.Allowed {
+			t.Fatal("expected update to be rejected")
+		}
+		if msg := out.Response.Result.Message; !strings.Contains(msg, `container "c1"`) || strings.Contains(msg, `container "c0"`) {
+			t.Fatalf("message %q should only name container c1", msg)
+		}
+	})
+}
+
+func TestValidate_DryRun(t *testing.T) {
+	srv := setupServer(t, "123456789012", "us-west-2", "docker.io")
+	srv.dryRunNamespaces = []string{"default"}
+	out := validatePod(t, srv, podWithImages("nginx"), nil)
+	if !out.Response.Allowed {
+		t.Fatalf("expected pod to be allowed in dry run, got %v", out.Response.Result)
+	}
+	if len(out.Response.Warnings) != 1 || !strings.Contains(out.Response.Warnings[0], "dry run: would be rejected: container \"c0\"") {
+		t.Fatalf("warnings = %q", out.Response.Warnings)
+	}
+	if _, ok := out.Response.AuditAnnotations["dry-run-rejections"]; !ok {
+		t.Fatalf("audit annotations = %v, want dry-run-rejections", out.Response.AuditAnnotations)
+	}
+}
+
+func TestValidateHandler(t *testing.T) {
+	ts := setupHTTPServer(t)
+	defer ts.Close()
+
+	podJSON, err := json.Marshal(podWithImages("nginx"))
+	if err != nil {
+		t.Fatalf("marshal pod: %v", err)
+	}
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  &admissionv1.AdmissionRequest{UID: "u1", Operation: admissionv1.Create, Object: runtime.RawExtension{Raw: podJSON}},
+	}
+	var out admissionv1.AdmissionReview
+	postReview(t, ts.URL+"/validate", review, &out)
+	if out.APIVersion != "admission.k8s.io/v1" {
+		t.Fatalf("apiVersion = %q", out.APIVersion)
+	}
+	if out.Response == nil || out.Response.UID != "u1" || out.Response.Allowed {
+		t.Fatalf("unexpected response: %+v", out.Response)
+	}
+	if want := "999999999999.dkr.ecr.eu-central-1.amazonaws.com/docker.io/library/nginx"; !strings.Contains(out.Response.Result.Message, want) {
+		t.Fatalf("message %q does not name %q", out.Response.Result.Message, want)
+	}
+}
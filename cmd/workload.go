@@ -0,0 +1,108 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// workload is an admitted object that carries a pod spec: a Pod itself or a
+// controller with a pod template.
+type workload struct {
+	kind        string
+	meta        metav1.ObjectMeta
+	podMeta     *metav1.ObjectMeta // metadata of the pod or pod template
+	podMetaPath string             // JSON pointer to podMeta within the object
+	podSpec     *corev1.PodSpec
+	specPath    string // JSON pointer to podSpec within the object
+}
+
+// name returns the object name, falling back to generateName for pods
+// created by controllers, which are not named yet at admission.
+func (w *workload) name() string {
+	return cmp.Or(w.meta.Name, w.meta.GenerateName)
+}
+
+// podTemplateObject covers every apps/v1 and batch/v1 kind that keeps its pod
+// template under spec.template.
+type podTemplateObject struct {
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              struct {
+		Template corev1.PodTemplateSpec `json:"template"`
+	} `json:"spec"`
+}
+
+// replicaSetControllers are the controllers that find their ReplicaSets by
+// comparing pod templates. A ReplicaSet they own is left alone: rewriting its
+// template without theirs makes them create ReplicaSets over and over.
+var replicaSetControllers = []metav1.GroupKind{
+	{Group: appsv1.GroupName, Kind: "Deployment"},
+	{Group: "argoproj.io", Kind: "Rollout"},
+}
+
+// decodeWorkload decodes the admitted object according to its kind. Requests
+// without a kind are treated as pods; other kinds without a pod spec, and
+// ReplicaSets of replicaSetControllers, return nil.
+func decodeWorkload(gvk metav1.GroupVersionKind, raw []byte) (*workload, error) {
+	switch {
+	case gvk.Kind == "" || (gvk.Group == "" && gvk.Kind == "Pod"):
+		var pod corev1.Pod
+		if err := json.Unmarshal(raw, &pod); err != nil {
+			return nil, fmt.Errorf("unable unmarshal pod json object %v", err)
+		}
+		return &workload{kind: "Pod", meta: pod.ObjectMeta, podMeta: &pod.ObjectMeta, podMetaPath: "/metadata", podSpec: &pod.Spec, specPath: "/spec"}, nil
+
+	case gvk.Group == appsv1.GroupName && (gvk.Kind == "Deployment" || gvk.Kind == "StatefulSet" || gvk.Kind == "DaemonSet" || gvk.Kind == "ReplicaSet"),
+		gvk.Group == batchv1.GroupName && gvk.Kind == "Job":
+		var obj podTemplateObject
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, fmt.Errorf("unable unmarshal %s json object %v", gvk.Kind, err)
+		}
+		if gvk.Kind == "ReplicaSet" && controlledByTemplateOwner(&obj.ObjectMeta) {
+			return nil, nil
+		}
+		template := &obj.Spec.Template
+		return &workload{kind: gvk.Kind, meta: obj.ObjectMeta, podMeta: &template.ObjectMeta, podMetaPath: "/spec/template/metadata", podSpec: &template.Spec, specPath: "/spec/template/spec"}, nil
+
+	case gvk.Group == batchv1.GroupName && gvk.Kind == "CronJob":
+		var cronJob batchv1.CronJob
+		if err := json.Unmarshal(raw, &cronJob); err != nil {
+			return nil, fmt.Errorf("unable unmarshal CronJob json object %v", err)
+		}
+		template := &cronJob.Spec.JobTemplate.Spec.Template
+		return &workload{kind: gvk.Kind, meta: cronJob.ObjectMeta, podMeta: &template.ObjectMeta, podMetaPath: "/spec/jobTemplate/spec/template/metadata", podSpec: &template.Spec, specPath: "/spec/jobTemplate/spec/template/spec"}, nil
+	}
+	return nil, nil
+}
+
+// controlledByTemplateOwner reports whether the controller of an object is
+// one of replicaSetControllers.
+func controlledByTemplateOwner(meta *metav1.ObjectMeta) bool {
+	owner := metav1.GetControllerOfNoCopy(meta)
+	if owner == nil {
+		return false
+	}
+	gv, err := schema.ParseGroupVersion(owner.APIVersion)
+	return err == nil && slices.Contains(replicaSetControllers, metav1.GroupKind{Group: gv.Group, Kind: owner.Kind})
+}
+
+// forEachContainer calls fn for the containers, initContainers and
+// ephemeralContainers of spec with the JSON pointer of each image field.
+func forEachContainer(spec *corev1.PodSpec, specPath string, fn func(name, image, path string)) {
+	for i, container := range spec.Containers {
+		fn(container.Name, container.Image, fmt.Sprintf("%s/containers/%d/image", specPath, i))
+	}
+	for i, initcontainer := range spec.InitContainers {
+		fn(initcontainer.Name, initcontainer.Image, fmt.Sprintf("%s/initContainers/%d/image", specPath, i))
+	}
+	for i, ephemeralcontainer := range spec.EphemeralContainers {
+		fn(ephemeralcontainer.Name, ephemeralcontainer.Image, fmt.Sprintf("%s/ephemeralContainers/%d/image", specPath, i))
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	v1beta1 "k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// reviewObject sends obj of the given kind through mutate and returns the
+// decoded AdmissionReview.
+func reviewObject(t *testing.T, srv *server, gvk metav1.GroupVersionKind, obj any) v1beta1.AdmissionReview {
+	t.Helper()
+	return reviewUpdate(t, srv, gvk, obj, nil)
+}
+
+// reviewUpdate is reviewObject for an UPDATE from old, or a CREATE when old
+// is nil.
+func reviewUpdate(t *testing.T, srv *server, gvk metav1.GroupVersionKind, obj, old any) v1beta1.AdmissionReview {
+	t.Helper()
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatalf("marshal object: %v", err)
+	}
+	req := &v1beta1.AdmissionRequest{
+		UID:       "test-uid",
+		Kind:      gvk,
+		Namespace: "default",
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+	if old != nil {
+		req.Operation = v1beta1.Update
+		if req.OldObject.Raw, err = json.Marshal(old); err != nil {
+			t.Fatalf("marshal old object: %v", err)
+		}
+	}
+	admReview := &v1beta1.AdmissionReview{Request: req}
+	body, err := json.Marshal(admReview)
+	if err != nil {
+		t.Fatalf("marshal admissionreview: %v", err)
+	}
+	mutated, err := srv.mutate(body)
+	if err != nil {
+		t.Fatalf("mutate error: %v", err)
+	}
+	out := v1beta1.AdmissionReview{}
+	if err := json.Unmarshal(mutated, &out); err != nil {
+		t.Fatalf("unmarshal mutated review: %v", err)
+	}
+	if out.Response == nil {
+		t.Fatalf("response is nil")
+	}
+	return out
+}
+
+// imagePatches returns the value of every image patch operation keyed by
+// path, leaving out the original-images annotation.
+func imagePatches(t *testing.T, out v1beta1.AdmissionReview) map[string]string {
+	t.Helper()
+	got := map[string]string{}
+	for _, p := range decodePatch(t, out) {
+		if strings.Contains(p.Path, "/metadata") {
+			continue
+		}
+		v, ok := p.Value.(string)
+		if !ok {
+			t.Fatalf("patch for %s has non-string value %v", p.Path, p.Value)
+		}
+		got[p.Path] = v
+	}
+	return got
+}
+
+// decodePatch returns the JSON patch of the response.
+func decodePatch(t *testing.T, out v1beta1.AdmissionReview) []patchOperation {
+	t.Helper()
+	var patches []patchOperation
+	if len(out.Response.Patch) == 0 {
+		return patches
+	}
+	if err := json.Unmarshal(out.Response.Patch, &patches); err != nil {
+		t.Fatalf("unmarshal patch: %v", err)
+	}
+	return patches
+}
+
+func TestMutate_Workloads(t *testing.T) {
+	srv := setupServer(t, "123456789012", "us-west-2", "docker.io")
+	template := corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Image: "busybox"}},
+			Containers:     []corev1.Container{{Name: "app", Image: "nginx:1.27"}},
+		},
+	}
+	meta := metav1.ObjectMeta{Name: "web", Namespace: "default"}
+	const (
+		wantInit = "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/busybox"
+		wantApp  = "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/nginx:1.27"
+	)
+
+	tests := []struct {
+		kind   metav1.GroupVersionKind
+		obj    any
+		prefix string
+	}{
+		{metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, &appsv1.Deployment{ObjectMeta: meta, Spec: appsv1.DeploymentSpec{Template: template}}, "/spec/template/spec"},
+		{metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"}, &appsv1.StatefulSet{ObjectMeta: meta, Spec: appsv1.StatefulSetSpec{Template: template}}, "/spec/template/spec"},
+		{metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "DaemonSet"}, &appsv1.DaemonSet{ObjectMeta: meta, Spec: appsv1.DaemonSetSpec{Template: template}}, "/spec/template/spec"},
+		{metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "ReplicaSet"}, &appsv1.ReplicaSet{ObjectMeta: meta, Spec: appsv1.ReplicaSetSpec{Template: template}}, "/spec/template/spec"},
+		{metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}, &batchv1.Job{ObjectMeta: meta, Spec: batchv1.JobSpec{Template: template}}, "/spec/template/spec"},
+		{metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "CronJob"}, &batchv1.CronJob{ObjectMeta: meta, Spec: batchv1.CronJobSpec{JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: template}}}}, "/spec/jobTemplate/spec/template/spec"},
+		{metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}, &corev1.Pod{ObjectMeta: meta, Spec: template.Spec}, "/spec"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.kind.Kind, func(t *testing.T) {
+			out := reviewObject(t, srv, tt.kind, tt.obj)
+			if !out.Response.Allowed {
+				t.Fatalf("not allowed: %+v", out.Response.Result)
+			}
+			got := imagePatches(t, out)
+			want := map[string]string{
+				tt.prefix + "/initContainers/0/image": wantInit,
+				tt.prefix + "/containers/0/image":     wantApp,
+			}
+			if len(got) != len(want) {
+				t.Fatalf("patches = %v, want %v", got, want)
+			}
+			for path, v := range want {
+				if got[path] != v {
+					t.Errorf("patch %s = %q, want %q", path, got[path], v)
+				}
+			}
+		})
+	}
+
+	t.Run("kinds without pod spec are allowed unchanged", func(t *testing.T) {
+		out := reviewObject(t, srv, metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, &corev1.ConfigMap{ObjectMeta: meta})
+		if !out.Response.Allowed {
+			t.Fatal("expected object to be allowed")
+		}
+		if got := imagePatches(t, out); len(got) != 0 {
+			t.Fatalf("expected no patches, got %v", got)
+		}
+	})
+}
+
+func TestMutate_WorkloadUpdate(t *testing.T) {
+	srv := setupServer(t, "123456789012", "us-west-2", "docker.io")
+	jobKind := metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "migrate", Namespace: "default"},
+		Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{originalImagesAnnotation: `{"app":"nginx:1.25"}`}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{
+				// Admitted while the webhook failed open.
+				{Name: "side", Image: "busybox"},
+				// Rewritten under a config that used another prefix.
+				{Name: "app", Image: "123456789012.dkr.ecr.us-west-2.amazonaws.com/dockerhub/library/nginx:1.25"},
+			}},
+		}},
+	}
+
+	t.Run("unchanged images are left alone", func(t *testing.T) {
+		updated := job.DeepCopy()
+		updated.Finalizers = nil
+		job := job.DeepCopy()
+		job.Finalizers = []string{"foregroundDeletion"}
+		out := reviewUpdate(t, srv, jobKind, updated, job)
+		if !out.Response.Allowed {
+			t.Fatalf("not allowed: %+v", out.Response.Result)
+		}
+		if patches := decodePatch(t, out); len(patches) != 0 {
+			t.Fatalf("expected no patches, got %+v", patches)
+		}
+	})
+
+	t.Run("changed images are rewritten", func(t *testing.T) {
+		kind := metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+		old := &appsv1.Deployment{ObjectMeta: job.ObjectMeta, Spec: appsv1.DeploymentSpec{Template: job.Spec.Template}}
+		updated := old.DeepCopy()
+		updated.Spec.Template.Spec.Containers[0].Image = "busybox:1.37"
+		out := reviewUpdate(t, srv, kind, updated, old)
+		got := imagePatches(t, out)
+		want := "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker.io/library/busybox:1.37"
+		if len(got) != 1 || got["/spec/template/spec/containers/0/image"] != want {
+			t.Fatalf("patches = %v, want only containers/0 rewritten to %s", got, want)
+		}
+		var originals any
+		for _, p := range decodePatch(t, out) {
+			if p.Path == "/spec/template/metadata/annotations/"+strings.ReplaceAll(originalImagesAnnotation, "/", "~1") {
+				originals = p.Value
+			}
+		}
+		if want := `{"app":"nginx:1.25","side":"busybox:1.37"}`; originals != want {
+			t.Errorf("original images = %v, want %s", originals, want)
+		}
+	})
+}
+
+func TestMutate_ControlledReplicaSets(t *testing.T) {
+	srv := setupServer(t, "123456789012", "us-west-2", "docker.io")
+	kind := metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "ReplicaSet"}
+	controller := true
+
+	tests := []struct {
+		name        string
+		owner       metav1.OwnerReference
+		wantPatches int
+	}{
+		{"Deployment", metav1.OwnerReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", Controller: &controller}, 0},
+		{"Rollout", metav1.OwnerReference{APIVersion: "argoproj.io/v1alpha1", Kind: "Rollout", Name: "web", Controller: &controller}, 0},
+		{"not the controller", metav1.OwnerReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "web"}, 1},
+		{"other controller", metav1.OwnerReference{APIVersion: "example.com/v1", Kind: "Deployment", Name: "web", Controller: &controller}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := &appsv1.ReplicaSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "web-5d4f8", Namespace: "default", OwnerReferences: []metav1.OwnerReference{tt.owner}},
+				Spec: appsv1.ReplicaSetSpec{Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx:1.27"}}},
+				}},
+			}
+			out := reviewObject(t, srv, kind, rs)
+			if !out.Response.Allowed {
+				t.Fatalf("not allowed: %+v", out.Response.Result)
+			}
+			if got := imagePatches(t, out); len(got) != tt.wantPatches {
+				t.Errorf("patches = %v, want %d", got, tt.wantPatches)
+			}
+		})
+	}
+}